@@ -0,0 +1,164 @@
+package iap
+
+import "sync"
+
+const (
+	messageBufferSize    = DataMessageHeaderLen + MaxMessageSize // fits a data frame of the maximum size
+	maxPooledMessageSize = 4 * messageBufferSize                 // larger message buffers are left to the GC
+)
+
+// chunkPool holds the fixed size chunks backing byteQueue.
+var chunkPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, MaxMessageSize)
+		return &b
+	},
+}
+
+// messagePool holds the buffers websocket messages are read into.
+var messagePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, messageBufferSize)
+		return &b
+	},
+}
+
+func getMessageBuffer() *[]byte {
+	return messagePool.Get().(*[]byte)
+}
+
+func putMessageBuffer(b *[]byte) {
+	if cap(*b) > maxPooledMessageSize {
+		return
+	}
+	*b = (*b)[:0]
+	messagePool.Put(b)
+}
+
+// byteQueue is a FIFO of bytes stored in pooled chunks of MaxMessageSize.
+// Bytes are never modified once written, so slices returned by Slices stay valid until they are discarded.
+type byteQueue struct {
+	chunks []*[]byte
+	off    int // read offset into the first chunk
+	len    int
+}
+
+// Len returns the number of queued bytes.
+func (q *byteQueue) Len() int {
+	return q.len
+}
+
+// Write appends p to the queue, filling the last chunk before taking a new one from the pool.
+func (q *byteQueue) Write(p []byte) {
+	q.len += len(p)
+	for len(p) > 0 {
+		if len(q.chunks) == 0 || len(*q.chunks[len(q.chunks)-1]) == MaxMessageSize {
+			q.chunks = append(q.chunks, chunkPool.Get().(*[]byte))
+		}
+
+		last := q.chunks[len(q.chunks)-1]
+		n := min(len(p), MaxMessageSize-len(*last))
+		*last = append(*last, p[:n]...)
+		p = p[n:]
+	}
+}
+
+// Read copies queued bytes into p and discards them.
+func (q *byteQueue) Read(p []byte) int {
+	n := 0
+	for n < len(p) && q.len > 0 {
+		copied := copy(p[n:], (*q.chunks[0])[q.off:])
+		q.Discard(copied)
+		n += copied
+	}
+	return n
+}
+
+// Discard drops n bytes from the front of the queue, returning chunks which were fully consumed to the pool.
+func (q *byteQueue) Discard(n int) {
+	q.len -= n
+	n += q.off
+	for len(q.chunks) > 0 && n >= len(*q.chunks[0]) {
+		n -= len(*q.chunks[0])
+		q.release()
+	}
+	q.off = n
+}
+
+// release returns the first chunk to the pool.
+func (q *byteQueue) release() {
+	*q.chunks[0] = (*q.chunks[0])[:0]
+	chunkPool.Put(q.chunks[0])
+	last := copy(q.chunks, q.chunks[1:])
+	q.chunks[last] = nil
+	q.chunks = q.chunks[:last]
+}
+
+// Truncate drops the last n queued bytes. They must not be referenced by a slice returned by Slices anymore.
+func (q *byteQueue) Truncate(n int) {
+	q.len -= n
+	for n > 0 {
+		last := q.chunks[len(q.chunks)-1]
+		start := 0
+		if len(q.chunks) == 1 {
+			start = q.off
+		}
+
+		dropped := min(n, len(*last)-start)
+		*last = (*last)[:len(*last)-dropped]
+		n -= dropped
+		if len(*last) > start {
+			break
+		}
+
+		*last = (*last)[:0]
+		chunkPool.Put(last)
+		q.chunks[len(q.chunks)-1] = nil
+		q.chunks = q.chunks[:len(q.chunks)-1]
+		if len(q.chunks) == 0 {
+			q.off = 0
+		}
+	}
+}
+
+// Slices calls fn for each contiguous slice of the queued bytes between from and to, in order.
+// Each slice is at most MaxMessageSize bytes long. Iteration stops at the first error.
+func (q *byteQueue) Slices(from, to int, fn func([]byte) error) error {
+	from += q.off
+	to += q.off
+	for _, chunk := range q.chunks {
+		if to <= 0 {
+			break
+		}
+
+		if from < len(*chunk) {
+			if err := fn((*chunk)[from:min(to, len(*chunk))]); err != nil {
+				return err
+			}
+		}
+		from = max(from-len(*chunk), 0)
+		to -= len(*chunk)
+	}
+	return nil
+}
+
+// Filled returns the number of queued bytes stored in completely filled chunks, which are not appended to anymore.
+func (q *byteQueue) Filled() int {
+	if len(q.chunks) == 0 {
+		return 0
+	}
+
+	last := len(*q.chunks[len(q.chunks)-1])
+	if last == MaxMessageSize {
+		return q.len
+	}
+	if len(q.chunks) == 1 {
+		return 0
+	}
+	return q.len - last
+}
+
+// Reset discards all queued bytes.
+func (q *byteQueue) Reset() {
+	q.Discard(q.len)
+}
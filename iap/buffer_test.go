@@ -0,0 +1,109 @@
+package iap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// queuedBytes returns a copy of the bytes in the queue.
+func queuedBytes(q *byteQueue) []byte {
+	var b []byte
+	q.Slices(0, q.Len(), func(s []byte) error {
+		b = append(b, s...)
+		return nil
+	})
+	return b
+}
+
+func TestByteQueueWriteRead(t *testing.T) {
+	data := make([]byte, 3*MaxMessageSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	var q byteQueue
+	q.Write(data[:10])
+	q.Write(data[10:])
+	assert.Equal(t, len(data), q.Len())
+	assert.Len(t, q.chunks, 4, "small writes are packed into the last chunk")
+	assert.Equal(t, data, queuedBytes(&q))
+
+	var out bytes.Buffer
+	buf := make([]byte, 1000)
+	for q.Len() > 0 {
+		n := q.Read(buf)
+		out.Write(buf[:n])
+	}
+	assert.Equal(t, data, out.Bytes())
+	assert.Empty(t, q.chunks, "consumed chunks are returned to the pool")
+	assert.Zero(t, q.Read(buf))
+}
+
+func TestByteQueueDiscardAndSlices(t *testing.T) {
+	var q byteQueue
+	q.Write(bytes.Repeat([]byte("a"), MaxMessageSize))
+	q.Write([]byte("bcdef"))
+
+	q.Discard(MaxMessageSize - 2)
+	assert.Equal(t, 7, q.Len())
+	assert.Len(t, q.chunks, 2)
+
+	var slices []string
+	assert.NoError(t, q.Slices(1, q.Len(), func(s []byte) error {
+		slices = append(slices, string(s))
+		return nil
+	}))
+	assert.Equal(t, []string{"a", "bcdef"}, slices, "slices follow chunk boundaries")
+
+	q.Discard(3)
+	assert.Len(t, q.chunks, 1)
+	assert.Equal(t, []byte("cdef"), queuedBytes(&q))
+
+	q.Reset()
+	assert.Zero(t, q.Len())
+	assert.Empty(t, q.chunks)
+}
+
+func TestByteQueueFilled(t *testing.T) {
+	var q byteQueue
+	assert.Zero(t, q.Filled())
+
+	q.Write([]byte("abc"))
+	assert.Zero(t, q.Filled(), "the last chunk is still appended to")
+
+	q.Write(make([]byte, MaxMessageSize))
+	assert.Equal(t, MaxMessageSize, q.Filled())
+
+	q.Discard(10)
+	assert.Equal(t, MaxMessageSize-10, q.Filled())
+
+	q.Write(make([]byte, MaxMessageSize-3))
+	assert.Equal(t, q.Len(), q.Filled())
+
+	var sizes []int
+	assert.NoError(t, q.Slices(5, q.Len()-5, func(s []byte) error {
+		sizes = append(sizes, len(s))
+		return nil
+	}))
+	assert.Equal(t, []int{MaxMessageSize - 15, MaxMessageSize - 5}, sizes, "slices are limited to the range")
+}
+
+func TestByteQueueTruncate(t *testing.T) {
+	var q byteQueue
+	q.Write([]byte("ab"))
+	q.Write(bytes.Repeat([]byte("c"), MaxMessageSize))
+	q.Discard(1)
+
+	q.Truncate(MaxMessageSize - 1)
+	assert.Equal(t, []byte("bc"), queuedBytes(&q))
+	assert.Len(t, q.chunks, 1, "emptied chunks are returned to the pool")
+
+	q.Truncate(2)
+	assert.Zero(t, q.Len())
+	assert.Empty(t, q.chunks)
+
+	q.Write([]byte("de"))
+	assert.Equal(t, []byte("de"), queuedBytes(&q))
+}
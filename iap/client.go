@@ -8,6 +8,7 @@
 //   - IAPTunnelClient: Manages the lifecycle of the TCP-over-IAP tunnel client, including listener setup,
 //     connection handling, and tunnel management.
 //   - NewIAPTunnelClient: Constructs a new IAPTunnelClient with the specified host, credentials, and local port.
+//   - Dial, Dialer: Open tunneled connections directly, without a local listener.
 //   - DryRun: Tests the connection to the IAP tunnel without establishing a full proxy.
 //   - Serve: Starts the listener and handles incoming connections, spawning a new IAP tunnel for each.
 //   - Close: Closes the listener and cleans up resources.
@@ -37,6 +38,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -55,6 +58,7 @@ func withKeepAlive(conn net.Conn) {
 }
 
 // tcpListener is a wrapper around net.Listener that adds retry logic for accepting connections.
+// Despite its name it also wraps the Unix socket listener.
 type tcpListener struct {
 	lis        net.Listener
 	retryCount int
@@ -91,13 +95,47 @@ func (l *tcpListener) Accept() (net.Conn, error, bool) {
 	return conn, nil, false
 }
 
-// newListener creates a new TCP listener wrapper on the specified port with retry logic.
-func newListener(ctx context.Context, port string) (*tcpListener, error) {
-	addr := fmt.Sprintf(":%s", port)
-	var lc net.ListenConfig
-	lis, err := lc.Listen(ctx, "tcp", addr)
+// addrs returns the addresses the listener is bound to.
+func (l *tcpListener) addrs() []string {
+	if ml, ok := l.lis.(*multiListener); ok {
+		var addrs []string
+		for _, addr := range ml.Addrs() {
+			addrs = append(addrs, addr.String())
+		}
+		return addrs
+	}
+	return []string{l.lis.Addr().String()}
+}
+
+// newListener creates a new TCP listener wrapper on the specified hosts and port with retry logic.
+// Without hosts it binds the loopback addresses, ::1 only if IPv6 is available.
+func newListener(ctx context.Context, hosts []string, port string, allowNonLoopback bool, log logger.Logger) (*tcpListener, error) {
+	optional := len(hosts) == 0
+	if optional {
+		hosts = defaultListenHosts
+	}
+
+	addrs, err := listenAddrs(hosts, port, allowNonLoopback, log)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create TCP listener on port %s: %w", port, err)
+		return nil, err
+	}
+
+	lis, err := listenAll(ctx, addrs, optional, log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TCP listener on %s: %w", strings.Join(addrs, ", "), err)
+	}
+
+	return &tcpListener{
+		lis:        lis,
+		retryCount: 3,
+	}, nil
+}
+
+// newUnixListener creates a new listener wrapper on the Unix socket at path with retry logic.
+func newUnixListener(ctx context.Context, path string, mode os.FileMode, group string) (*tcpListener, error) {
+	lis, err := listenUnix(ctx, path, mode, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Unix socket listener on %s: %w", path, err)
 	}
 
 	return &tcpListener{
@@ -108,33 +146,63 @@ func newListener(ctx context.Context, port string) (*tcpListener, error) {
 
 // IAPTunnelClient manages a TCP-over-IAP tunnel client that listens for local connections
 type IAPTunnelClient struct {
-	logger      logger.Logger
-	mu          sync.Mutex
-	active      bool
-	tokenSource oauth2.TokenSource
-	host        IAPHost
-	localPort   string
-	lis         *tcpListener
+	logger           logger.Logger
+	mu               sync.Mutex
+	active           bool
+	tokenSource      oauth2.TokenSource
+	host             IAPHost
+	localPort        string
+	listenHosts      []string // loopback addresses if empty
+	allowNonLoopback bool     // allow listening on non-loopback addresses
+	socketPath       string   // Unix socket listened on instead of the local port, if set
+	socketMode       os.FileMode
+	socketGroup      string
+	sendWindow       int
+	receiveBuffer    int
+	coalesceDelay    time.Duration
+	pingInterval     time.Duration
+	pongTimeout      time.Duration
+	idleTimeout      time.Duration
+	retryPolicy      RetryPolicy
+	relay            *relayDialer
+	lis              *tcpListener
+	ready            chan struct{} // closed once Serve is listening
 }
 
-// getHost is thread-safe method to retrieve the IAP host configuration.
-func (c *IAPTunnelClient) getHost() IAPHost {
+// newTunnel is a thread-safe method to create a new IAP tunnel with the client configuration.
+func (c *IAPTunnelClient) newTunnel() (*IAPTunnel, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.host
-}
+	tunnel := NewIAPTunnel(c.host, c.tokenSource, c.logger)
+	if c.relay != nil {
+		tunnel.relay = c.relay
+	}
 
-// getTokenSource is a thread-safe method to retrieve the token source for authentication.
-func (c *IAPTunnelClient) getTokenSource() oauth2.TokenSource {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.tokenSource
-}
+	if err := tunnel.SetSendWindow(c.sendWindow); err != nil {
+		return nil, err
+	}
 
-func (c *IAPTunnelClient) getLogger() logger.Logger {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.logger
+	if err := tunnel.SetReceiveBuffer(c.receiveBuffer); err != nil {
+		return nil, err
+	}
+
+	if err := tunnel.SetCoalesceDelay(c.coalesceDelay); err != nil {
+		return nil, err
+	}
+
+	if err := tunnel.SetPingInterval(c.pingInterval, c.pongTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := tunnel.SetIdleTimeout(c.idleTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := tunnel.SetRetryPolicy(c.retryPolicy); err != nil {
+		return nil, err
+	}
+
+	return tunnel, nil
 }
 
 // setActive is a thread-safe method to set the active state of the IAPTunnelClient.
@@ -194,6 +262,174 @@ func (c *IAPTunnelClient) SetLogger(logger logger.Logger) error {
 	return nil
 }
 
+// SetListenAddr sets the hosts the local listener binds to, e.g. "127.0.0.1", "::1", "::" for all interfaces
+// with dual-stack, or the address of a specific network interface. The port is the local port of the client.
+// By default only the loopback addresses are bound. Non-loopback addresses must be allowed with SetAllowNonLoopback.
+// It must be called before Serve.
+func (c *IAPTunnelClient) SetListenAddr(hosts ...string) error {
+	if len(hosts) == 0 {
+		return errors.New("no listen address given")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listenHosts = hosts
+	return nil
+}
+
+// SetAllowNonLoopback allows the local listener to bind non-loopback addresses. Anyone who can reach such an
+// address can use the tunnel, and with it the IAP identity of the client, so a warning is logged.
+// It must be called before Serve.
+func (c *IAPTunnelClient) SetAllowNonLoopback(allow bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.allowNonLoopback = allow
+	return nil
+}
+
+// SetUnixSocket makes the client listen on the Unix socket at path instead of the local port, e.g. for
+// ssh -o ProxyCommand='nc -U path'. The socket gets the file mode, DefaultSocketMode if it is 0, so only its owner
+// can connect. If group is set, the socket is handed to that group, given by name or ID, and mode may grant it access.
+// A stale socket file left behind by a previous process is replaced. It must be called before Serve.
+func (c *IAPTunnelClient) SetUnixSocket(path string, mode os.FileMode, group string) error {
+	if path == "" {
+		return errors.New("socket path is empty")
+	}
+
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+
+	if mode&^os.ModePerm != 0 {
+		return fmt.Errorf("socket mode must only contain permission bits, got %s", mode)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.socketPath = path
+	c.socketMode = mode
+	c.socketGroup = group
+	return nil
+}
+
+// SetRelayEndpoint sets the base URL of the relay used by all tunnels, e.g. "ws://127.0.0.1:8080" for a local test relay.
+func (c *IAPTunnelClient) SetRelayEndpoint(endpoint string) error {
+	return c.SetRelayConfig(RelayConfig{Endpoint: endpoint})
+}
+
+// SetRelayConfig sets the endpoint, HTTP transport, TLS settings and timeouts used by all tunnels to connect to the relay.
+func (c *IAPTunnelClient) SetRelayConfig(cfg RelayConfig) error {
+	relay, err := newRelayDialer(cfg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.relay = relay
+	return nil
+}
+
+// SetSendWindow sets the maximum number of unacknowledged bytes each tunnel may send to the relay.
+func (c *IAPTunnelClient) SetSendWindow(size int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size < MinSendWindow {
+		return fmt.Errorf("send window must be at least %d bytes, got %d", MinSendWindow, size)
+	}
+
+	c.sendWindow = size
+	return nil
+}
+
+// SetReceiveBuffer sets the maximum number of received bytes each tunnel buffers until the local connection reads them.
+// It bounds the memory used per tunnel when the local client reads slowly.
+func (c *IAPTunnelClient) SetReceiveBuffer(size int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size < MinReceiveBuffer {
+		return fmt.Errorf("receive buffer must be at least %d bytes, got %d", MinReceiveBuffer, size)
+	}
+
+	c.receiveBuffer = size
+	return nil
+}
+
+// SetCoalesceDelay enables write coalescing for each tunnel, see IAPTunnel.SetCoalesceDelay.
+// Coalescing is disabled by default, it suits bulk transfers rather than interactive sessions.
+func (c *IAPTunnelClient) SetCoalesceDelay(delay time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if delay < 0 {
+		return fmt.Errorf("coalesce delay must not be negative, got %s", delay)
+	}
+
+	c.coalesceDelay = delay
+	return nil
+}
+
+// SetPingInterval sets how often each tunnel pings the relay and how long it waits for the pong before the websocket
+// is considered dead, see IAPTunnel.SetPingInterval. An interval of 0 disables pings.
+func (c *IAPTunnelClient) SetPingInterval(interval, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if interval < 0 {
+		return fmt.Errorf("ping interval must not be negative, got %s", interval)
+	}
+
+	if interval > 0 && timeout <= 0 {
+		return fmt.Errorf("pong timeout must be positive, got %s", timeout)
+	}
+
+	c.pingInterval = interval
+	c.pongTimeout = timeout
+	return nil
+}
+
+// SetIdleTimeout closes tunnels which did not send or receive data for timeout, together with their local connection.
+// A timeout of 0 disables it, which is the default.
+func (c *IAPTunnelClient) SetIdleTimeout(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if timeout < 0 {
+		return fmt.Errorf("idle timeout must not be negative, got %s", timeout)
+	}
+
+	c.idleTimeout = timeout
+	return nil
+}
+
+// SetRetryPolicy sets how transient failures to establish a tunnel are retried. Zero fields select their defaults,
+// see DefaultRetryPolicy. Once a tunnel fails for good, its local connection is closed.
+func (c *IAPTunnelClient) SetRetryPolicy(policy RetryPolicy) error {
+	policy, err := policy.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retryPolicy = policy
+	return nil
+}
+
+// Ready returns a channel that is closed once Serve is listening for local connections.
+func (c *IAPTunnelClient) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Addr returns the address Serve listens on, or nil until Ready is closed. With local port "0" it tells the port
+// which was picked. If several loopback addresses are bound, it returns the first one, usually 127.0.0.1.
+// For a Unix socket it is the *net.UnixAddr of the socket.
+func (c *IAPTunnelClient) Addr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lis == nil {
+		return nil
+	}
+	return c.lis.lis.Addr()
+}
+
 // Close is a thread-safe method to close the TCP listener and clean up resources.
 func (c *IAPTunnelClient) Close() error {
 	c.mu.Lock()
@@ -211,7 +447,11 @@ func (c *IAPTunnelClient) DryRun() error {
 		return err
 	}
 
-	tunnel := NewIAPTunnel(c.getHost(), c.getTokenSource(), c.getLogger())
+	tunnel, err := c.newTunnel()
+	if err != nil {
+		return err
+	}
+
 	return tunnel.DryRun(context.Background())
 }
 
@@ -229,22 +469,36 @@ func (c *IAPTunnelClient) Serve(ctx context.Context) error {
 	c.setActive(true)
 	defer c.setActive(false)
 
-	if c.lis == nil {
-		c.lis, err = newListener(ctx, c.localPort)
+	c.mu.Lock()
+	lis := c.lis
+	hosts, allowNonLoopback := c.listenHosts, c.allowNonLoopback
+	socketPath, socketMode, socketGroup := c.socketPath, c.socketMode, c.socketGroup
+	c.mu.Unlock()
+	if lis == nil {
+		if socketPath != "" {
+			lis, err = newUnixListener(ctx, socketPath, socketMode, socketGroup)
+		} else {
+			lis, err = newListener(ctx, hosts, c.localPort, allowNonLoopback, c.logger)
+		}
 		if err != nil {
 			return err
 		}
+
+		c.mu.Lock()
+		c.lis = lis
+		close(c.ready)
+		c.mu.Unlock()
 	}
 
-	defer c.lis.Close()
+	defer lis.Close()
 
 	defer func() {
 		c.logger.Info("TCP-over-IAP listener closed, shutting down")
 	}()
 
-	c.logger.Info("TCP-over-IAP listener is ready", "addr", c.lis.Addr().String())
+	c.logger.Info("TCP-over-IAP listener is ready", "addr", strings.Join(lis.addrs(), ", "))
 	for {
-		conn, err, connClosed := c.lis.Accept()
+		conn, err, connClosed := lis.Accept()
 		if connClosed {
 			return nil // Listener closed, exit gracefully
 		}
@@ -261,23 +515,71 @@ func (c *IAPTunnelClient) Serve(ctx context.Context) error {
 // processConn handles a new connection by establishing an IAP tunnel and synchronizing data between the connection and the tunnel.
 // each TCP connection receives a new IAP tunnel instance.
 func (c *IAPTunnelClient) processConn(ctx context.Context, conn net.Conn) {
-	c.logger.Info("New connection accepted", "remote_addr", conn.RemoteAddr().String())
-	tunnel := NewIAPTunnel(c.getHost(), c.getTokenSource(), c.getLogger())
-	tunnel.Start(ctx)
+	c.logger.Info("New connection accepted", "remote_addr", remoteAddr(conn))
+	err := c.proxy(ctx, conn)
+	if err != nil && ctx.Err() == nil && !errors.Is(err, ErrIdleTimeout) {
+		c.logger.Error("Proxy error", "err", err)
+	}
+}
+
+// ServeConn proxies a single connection through a new IAP tunnel without a listener, e.g. stdin and stdout of an
+// SSH ProxyCommand, see ServeStdio. It returns once both directions are done and conn has been closed.
+// The error is nil if either side closed the connection normally and tells why the session ended otherwise.
+func (c *IAPTunnelClient) ServeConn(ctx context.Context, conn io.ReadWriteCloser) error {
+	if err := c.checkCredentials(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	if err := c.proxy(ctx, conn); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// ServeStdio proxies in and out, usually os.Stdin and os.Stdout, through a new IAP tunnel like
+// gcloud compute start-iap-tunnel --listen-on-stdin. EOF on in shuts down the sending side of the tunnel, but the
+// relay can not forward it, see IAPTunnel.CloseWrite, so the session lasts until the remote side ends the stream.
+// out is closed then, and ServeStdio returns once in has reached EOF as well.
+// Logs must not be written to out, the default logger writes to stderr.
+func (c *IAPTunnelClient) ServeStdio(ctx context.Context, in io.Reader, out io.WriteCloser) error {
+	return c.ServeConn(ctx, newStdioConn(in, out))
+}
+
+// proxy establishes a new IAP tunnel and synchronizes data between conn and the tunnel until both are done.
+// Both are closed when it returns. Connections closed by either side are not reported as errors.
+func (c *IAPTunnelClient) proxy(ctx context.Context, conn io.ReadWriteCloser) error {
+	tunnel, err := c.newTunnel()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create IAP tunnel: %w", err)
+	}
+
 	defer tunnel.Close()
 	defer conn.Close()
 
-	select {
-	case <-tunnel.Ready():
-		// Tunnel is ready
-	case <-ctx.Done():
-		return
+	// The local connection is closed as soon as connecting fails, so the client does not wait for a dead tunnel
+	if err := tunnel.connect(ctx); err != nil {
+		return fmt.Errorf("failed to establish IAP tunnel: %w", err)
+	}
+
+	err = syncConnections(ctx, conn, tunnel)
+	if tunnelErr := tunnel.Err(); tunnelErr != nil && tunnelErr != io.EOF {
+		err = tunnelErr // report the root cause rather than the failed copy
 	}
 
-	err := syncConnections(ctx, conn, tunnel)
 	if err != nil && !isConnectionClosed(err) {
-		c.logger.Error("Proxy error", "err", err)
+		return err
+	}
+	return nil
+}
+
+// remoteAddr returns the address of the peer of conn for logging. Peers of Unix sockets are usually unnamed.
+func remoteAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil && addr.String() != "" {
+		return addr.String()
 	}
+	return conn.LocalAddr().Network()
 }
 
 // isConnectionClosed checks if the error indicates that the listener's connection has been closed.
@@ -285,16 +587,35 @@ func isConnectionClosed(err error) bool {
 	return errors.Is(err, context.Canceled) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF)
 }
 
+// closeWrite signals EOF to the peer of conn. Connections which can not be half-closed are closed.
+func closeWrite(conn io.Closer) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// copyConn copies data until source hits EOF and passes the EOF on to target.
 func copyConn(target, source io.ReadWriteCloser) func() error {
 	return func() error {
-		_, err := io.Copy(target, source)
-		return err
+		if _, err := io.Copy(target, source); err != nil {
+			return err
+		}
+		return closeWrite(target)
 	}
 }
 
 // syncConnections synchronizes data between two connections.
+// EOF on one side half-closes the other one while the opposite direction keeps draining, so a client which shuts
+// down its sending side still receives the reply. Both connections are closed once a copy fails or ctx is done.
 func syncConnections(ctx context.Context, source, target io.ReadWriteCloser) error {
-	g, _ := errgroup.WithContext(ctx)
+	g, gctx := errgroup.WithContext(ctx)
+	stop := context.AfterFunc(gctx, func() {
+		source.Close()
+		target.Close()
+	})
+	defer stop()
+
 	g.Go(copyConn(target, source))
 	g.Go(copyConn(source, target))
 	return g.Wait()
@@ -302,6 +623,7 @@ func syncConnections(ctx context.Context, source, target io.ReadWriteCloser) err
 
 // NewIAPTunnelClient creates a new IAPTunnelClient with the specified host, credentials, and local port.
 // It initializes the client with default values if not provided, and validates the credentials.
+// Local port "0" picks a free port once Serve starts listening, see Addr.
 // Example usage:
 //
 //	host := IAPHost{ProjectID: "my-project", Zone: "us-central1-a", Instance: "my-instance"}
@@ -311,16 +633,26 @@ func syncConnections(ctx context.Context, source, target io.ReadWriteCloser) err
 //	client.Serve(context.Background())
 func NewIAPTunnelClient(host IAPHost, localPort string) (*IAPTunnelClient, error) {
 	client := &IAPTunnelClient{
-		host:      host,
-		localPort: localPort,
+		host:          host,
+		localPort:     localPort,
+		sendWindow:    DefaultSendWindow,
+		receiveBuffer: DefaultReceiveBuffer,
+		pingInterval:  DefaultPingInterval,
+		pongTimeout:   DefaultPongTimeout,
+		retryPolicy:   DefaultRetryPolicy(),
+		ready:         make(chan struct{}),
 	}
 
 	client.logger, _ = logger.NewZapLogger("info") // Default logger
 
-	if client.host.Instance == "" {
+	if !client.host.IsHostMode() && client.host.Interface == "" {
 		client.host.Interface = "nic0"
 	}
 
+	if err := client.host.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid IAP host: %w", err)
+	}
+
 	if client.localPort == "" {
 		client.localPort = "2201" // Default local port if not specified
 	}
@@ -1,8 +1,11 @@
 package iap
 
+import "time"
+
 const (
 	// IAPHostURL is the base URL for the Identity-Aware Proxy (IAP) tunnel service.
 	IAPHostURL        = "tunnel.cloudproxy.app"
+	MTLSHostURL       = "mtls.tunnel.cloudproxy.app" // Relay host enforcing certificate-based access
 	WebSocketProtocol = "wss"
 	ConnectPath       = "/v4/connect"
 	ReconnectPath     = "/v4/reconnect"
@@ -26,11 +29,39 @@ const (
 	SIDHeaderLen         = MessageTagLen + SIDLen     // Length of the SID message header in bytes (2 bytes for tag + 4 bytes for length)
 	ACKHeaderLen         = MessageTagLen + ACKLen     // Length of the ACK message header in bytes (2 bytes for tag + 8 bytes for length)
 	MaxMessageSize       = 1024 * 16                  // Maximum default message size in bytes (16 KB). Defined by the protocol specification.
-	HangedMessageLen     = 51                         // Length of the message that is received when the connection is hanged
+	HangedMessageLen     = 51                         // Length of the message that is received when the connection is hanged, it is not a valid frame
+
+	maxCloseReasonLen = 123 // Close frame payload is limited to 125 bytes, 2 of them are used by the status code
+	reconnectAttempts = 3   // Number of attempts to resume a session after the websocket is lost
+	outboundQueueLen  = 64  // Number of frames queued for the writer loop before Write blocks
+
+	tokenRefreshMargin = 30 * time.Second // Access tokens are refreshed this long before they expire, at most halfway through their lifetime
+	tokenRefreshRetry  = 5 * time.Second  // Interval to ask the token source again while it returns the cached token
+	maxRejectedWait    = 5 * time.Minute  // Longest wait for a token rejected by the relay to expire, covers clock skew but not revocation
+
+	DefaultDialTimeout      = 30 * time.Second // Default timeout for the TCP connection to the relay
+	DefaultHandshakeTimeout = 30 * time.Second // Default timeout for the TLS and websocket handshakes with the relay
+
+	DefaultPingInterval = 30 * time.Second // Default interval of websocket pings to the relay
+	DefaultPongTimeout  = 20 * time.Second // Default time to wait for a pong before the websocket is considered dead
+
+	DefaultConnectAttempts = 5                      // Default number of attempts to establish a new session
+	DefaultInitialBackoff  = 500 * time.Millisecond // Default wait before the first connect retry, doubled with every attempt
+	DefaultMaxBackoff      = 10 * time.Second       // Default upper bound of the wait between connect attempts
+	DefaultBackoffJitter   = 0.2                    // Default fraction of the wait which is randomized
+	DefaultConnectTimeout  = time.Minute            // Default overall deadline for establishing a new session
+
+	DefaultSocketMode = 0o600 // Default file mode of the Unix socket listener, only its owner can connect
+
+	DefaultSendWindow = 1024 * 1024        // Default number of unacknowledged outbound bytes before Write blocks (1 MB)
+	MinSendWindow     = MaxMessageSize * 4 // Minimum send window. The relay ACKs data in batches, a smaller window may stall.
+
+	DefaultReceiveBuffer = 1024 * 1024        // Default number of received bytes buffered until they are read (1 MB)
+	MinReceiveBuffer     = MaxMessageSize * 4 // Minimum receive buffer, enough to keep the relay sending between ACKs
 
 	CloseStatusNormal          = 1000
 	CloseStatusAbnormalClosure = 1006
-	// Custom statuses. Not used at the moment.
+	// Custom statuses sent by the relay. See closeStatusErrors for the matching sentinel errors.
 	CloseStatusErrorUnknown             = 4000
 	CloseStatusSIDUnknown               = 4001
 	CloseStatusSIDInUse                 = 4002
@@ -48,3 +79,7 @@ const (
 	CloseStatusLookupFailedReconnect    = 4051
 	CloseStatusFailedToRewind           = 4074
 )
+
+// flushTimeout is the maximum time Close waits for held back bytes to be queued and for queued frames to be
+// written. It is a variable so tests do not have to wait that long.
+var flushTimeout = 10 * time.Second
@@ -0,0 +1,87 @@
+package iap
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a read or write deadline of a tunnel, blocked operations fail with os.ErrDeadlineExceeded once it passed.
+// Operations waiting on a sync.Cond are woken up by onExpire, operations waiting on a channel select on wait.
+type deadline struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	expired  chan struct{} // closed once the deadline has passed
+	gen      uint64        // invalidates timers of previous deadlines
+	onExpire func()
+}
+
+func newDeadline(onExpire func()) *deadline {
+	return &deadline{
+		expired:  make(chan struct{}),
+		onExpire: onExpire,
+	}
+}
+
+// set sets the deadline, a zero value means no deadline. A deadline in the past expires immediately.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.gen++
+
+	if isClosedChan(d.expired) {
+		d.expired = make(chan struct{})
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	dur := time.Until(t)
+	if dur <= 0 {
+		d.expire()
+		return
+	}
+
+	gen := d.gen
+	d.timer = time.AfterFunc(dur, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.gen == gen {
+			d.expire()
+		}
+	})
+}
+
+// expire marks the deadline as passed and wakes up blocked operations.
+// Must be called with mu held.
+func (d *deadline) expire() {
+	close(d.expired)
+	if d.onExpire != nil {
+		go d.onExpire() // waiters call exceeded while holding the lock onExpire takes, so it can not run under mu
+	}
+}
+
+// wait returns a channel which is closed once the deadline has passed.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+// exceeded reports whether the deadline has passed.
+func (d *deadline) exceeded() bool {
+	return isClosedChan(d.wait())
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,267 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nicksulia/go-tcp-over-google-iap/credentials"
+	"github.com/nicksulia/go-tcp-over-google-iap/logger"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Dialer opens connections over IAP without a local listener. Each connection is a separate tunnel.
+//
+// Its DialContext method plugs into APIs which take a dial function, e.g. http.Transport.DialContext,
+// grpc.WithContextDialer or the dialer hooks of database/sql drivers:
+//
+//	d := &iap.Dialer{Host: iap.IAPHost{ProjectID: "my-project", Zone: "us-central1-a"}}
+//	transport := &http.Transport{DialContext: d.DialContext}
+//	res, err := (&http.Client{Transport: transport}).Get("http://my-vm:8080/") // port 8080 of instance my-vm
+//
+// A Dialer must not be modified after its first use, it is safe for concurrent use.
+type Dialer struct {
+	// Host describes the destinations. DialContext takes the instance name, or the destination host when Region
+	// is set, and the port from the dialed address.
+	Host IAPHost
+	// TokenSource authenticates the tunnels, Application Default Credentials are used if it is nil.
+	TokenSource oauth2.TokenSource
+	// Relay configures the connection to the relay.
+	Relay RelayConfig
+	// Logger defaults to a zap logger at info level.
+	Logger logger.Logger
+	// SendWindow, ReceiveBuffer and CoalesceDelay configure each tunnel, see the IAPTunnel setters.
+	// Zero values use the defaults.
+	SendWindow    int
+	ReceiveBuffer int
+	CoalesceDelay time.Duration
+	// PingInterval and PongTimeout configure the websocket pings of each tunnel, see IAPTunnel.SetPingInterval.
+	// Zero values use DefaultPingInterval and DefaultPongTimeout. Unlike the setters, an interval of 0 does not
+	// disable pings, set DisablePings instead.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	DisablePings bool
+	// IdleTimeout closes tunnels without traffic, see IAPTunnel.SetIdleTimeout. Zero disables it.
+	IdleTimeout time.Duration
+	// Retry controls how transient failures to establish a tunnel are retried, zero fields use the defaults.
+	// The retries are bounded by the context passed to Dial as well.
+	Retry RetryPolicy
+
+	initOnce    sync.Once
+	initErr     error
+	tokenSource oauth2.TokenSource
+	logger      logger.Logger
+	relay       *relayDialer
+}
+
+// DialOption configures the Dialer used by Dial.
+type DialOption func(*Dialer)
+
+// WithTokenSource sets the token source used to authenticate the tunnel.
+func WithTokenSource(source oauth2.TokenSource) DialOption {
+	return func(d *Dialer) {
+		d.TokenSource = source
+	}
+}
+
+// WithCredentials authenticates the tunnel with the token source of the given credentials.
+func WithCredentials(creds *google.Credentials) DialOption {
+	return func(d *Dialer) {
+		if creds != nil {
+			d.TokenSource = creds.TokenSource
+		}
+	}
+}
+
+// WithRelayConfig sets the endpoint, HTTP transport, TLS settings and timeouts used to connect to the relay.
+func WithRelayConfig(cfg RelayConfig) DialOption {
+	return func(d *Dialer) {
+		d.Relay = cfg
+	}
+}
+
+// WithLogger sets the logger of the tunnel.
+func WithLogger(l logger.Logger) DialOption {
+	return func(d *Dialer) {
+		d.Logger = l
+	}
+}
+
+// WithSendWindow sets the send window of the tunnel, see IAPTunnel.SetSendWindow.
+func WithSendWindow(size int) DialOption {
+	return func(d *Dialer) {
+		d.SendWindow = size
+	}
+}
+
+// WithReceiveBuffer sets the receive buffer of the tunnel, see IAPTunnel.SetReceiveBuffer.
+func WithReceiveBuffer(size int) DialOption {
+	return func(d *Dialer) {
+		d.ReceiveBuffer = size
+	}
+}
+
+// WithCoalesceDelay enables write coalescing, see IAPTunnel.SetCoalesceDelay.
+func WithCoalesceDelay(delay time.Duration) DialOption {
+	return func(d *Dialer) {
+		d.CoalesceDelay = delay
+	}
+}
+
+// WithPingInterval sets the websocket ping interval and pong timeout of the tunnel, see IAPTunnel.SetPingInterval.
+// A negative interval disables pings.
+func WithPingInterval(interval, timeout time.Duration) DialOption {
+	return func(d *Dialer) {
+		d.PingInterval = interval
+		d.PongTimeout = timeout
+	}
+}
+
+// WithIdleTimeout closes the tunnel once no data was sent or received for timeout, see IAPTunnel.SetIdleTimeout.
+func WithIdleTimeout(timeout time.Duration) DialOption {
+	return func(d *Dialer) {
+		d.IdleTimeout = timeout
+	}
+}
+
+// WithRetryPolicy sets how transient failures to establish the tunnel are retried, see RetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) DialOption {
+	return func(d *Dialer) {
+		d.Retry = policy
+	}
+}
+
+// Dial opens a tunnel to the host and returns once the relay has established the session.
+// ctx only bounds connecting, the connection stays open until it is closed.
+// Failures are returned as *net.OpError wrapping the typed relay errors, e.g. ErrNotAuthorized or *HandshakeError.
+func Dial(ctx context.Context, host IAPHost, opts ...DialOption) (net.Conn, error) {
+	d := &Dialer{Host: host}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d.dial(ctx, host)
+}
+
+// DialContext opens a tunnel to addr, which is "instance:port", or "host:port" when the Dialer is in host mode.
+// The network must be "tcp", "tcp4" or "tcp6". See Dial.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	name, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	host := d.Host
+	if host.Region != "" {
+		host.Host = name
+	} else {
+		host.Instance = name
+	}
+	host.Port = port
+	return d.dial(ctx, host)
+}
+
+func (d *Dialer) dial(ctx context.Context, host IAPHost) (net.Conn, error) {
+	if !host.IsHostMode() && host.Interface == "" {
+		host.Interface = "nic0"
+	}
+
+	tunnel, err := d.newTunnel(host)
+	if err == nil {
+		err = tunnel.connect(ctx)
+	}
+
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "iap", Addr: &IAPAddr{Host: host}, Err: err}
+	}
+	return tunnel, nil
+}
+
+// newTunnel creates a tunnel to host with the Dialer configuration.
+func (d *Dialer) newTunnel(host IAPHost) (*IAPTunnel, error) {
+	if err := host.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid IAP host: %w", err)
+	}
+
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+
+	tunnel := NewIAPTunnel(host, d.tokenSource, d.logger)
+	tunnel.relay = d.relay
+	if d.SendWindow != 0 {
+		if err := tunnel.SetSendWindow(d.SendWindow); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.ReceiveBuffer != 0 {
+		if err := tunnel.SetReceiveBuffer(d.ReceiveBuffer); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tunnel.SetCoalesceDelay(d.CoalesceDelay); err != nil {
+		return nil, err
+	}
+
+	pingInterval, pongTimeout := d.PingInterval, d.PongTimeout
+	if pingInterval == 0 {
+		pingInterval = DefaultPingInterval
+	}
+	if pongTimeout == 0 {
+		pongTimeout = DefaultPongTimeout
+	}
+	if d.DisablePings {
+		pingInterval = 0
+	}
+	if err := tunnel.SetPingInterval(pingInterval, pongTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := tunnel.SetIdleTimeout(d.IdleTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := tunnel.SetRetryPolicy(d.Retry); err != nil {
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// init resolves the defaults and the relay configuration once.
+func (d *Dialer) init() error {
+	d.initOnce.Do(func() {
+		d.logger = d.Logger
+		if d.logger == nil {
+			d.logger, _ = logger.NewZapLogger("info")
+		}
+
+		d.tokenSource = d.TokenSource
+		if d.tokenSource == nil {
+			creds, err := credentials.DefaultCredentials(context.Background())
+			if err != nil {
+				d.initErr = err
+				return
+			}
+
+			if creds == nil || creds.TokenSource == nil {
+				d.initErr = errors.New("default credentials token source is nil")
+				return
+			}
+			d.tokenSource = creds.TokenSource
+		}
+
+		d.relay, d.initErr = newRelayDialer(d.Relay)
+	})
+	return d.initErr
+}
@@ -0,0 +1,169 @@
+package iap_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nicksulia/go-tcp-over-google-iap/iap"
+	"github.com/nicksulia/go-tcp-over-google-iap/iap/iaptest"
+	"github.com/nicksulia/go-tcp-over-google-iap/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func testDialOptions(t *testing.T, relay *iaptest.Relay) []iap.DialOption {
+	log, err := logger.NewZapLogger("error")
+	require.NoError(t, err)
+
+	return []iap.DialOption{
+		iap.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"})),
+		iap.WithRelayConfig(iap.RelayConfig{Endpoint: relay.URL}),
+		iap.WithLogger(log),
+	}
+}
+
+func TestDial(t *testing.T) {
+	relay := startRelay(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := iap.Dial(ctx, testHost, testDialOptions(t, relay)...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	cancel() // the context only bounds connecting
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	received := make([]byte, 4)
+	_, err = io.ReadFull(conn, received)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(received))
+	assert.Equal(t, 1, relay.Connects())
+}
+
+func TestDialRejected(t *testing.T) {
+	relay := startRelay(t)
+	relay.RejectConnections(iap.CloseStatusNotAuthorized)
+
+	_, err := iap.Dial(context.Background(), testHost, testDialOptions(t, relay)...)
+	assert.ErrorIs(t, err, iap.ErrNotAuthorized)
+	var opErr *net.OpError
+	if assert.ErrorAs(t, err, &opErr) {
+		assert.Equal(t, "dial", opErr.Op)
+		assert.Equal(t, "test-project/us-central1-a/test-instance:22", opErr.Addr.String())
+	}
+}
+
+func TestDialInvalidHost(t *testing.T) {
+	relay := startRelay(t)
+
+	_, err := iap.Dial(context.Background(), iap.IAPHost{ProjectID: "test-project", Port: "22"}, testDialOptions(t, relay)...)
+	assert.Error(t, err)
+	assert.Zero(t, relay.Connects())
+}
+
+func TestDialContextCancelled(t *testing.T) {
+	// A relay which accepts TCP connections but never answers the handshake
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	opts := []iap.DialOption{
+		iap.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"})),
+		iap.WithRelayConfig(iap.RelayConfig{Endpoint: "ws://" + lis.Addr().String()}),
+	}
+
+	_, err = iap.Dial(ctx, testHost, opts...)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+}
+
+func TestDialerPings(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		relay := startRelay(t)
+		dialer := &iap.Dialer{Host: testHost, PingInterval: 20 * time.Millisecond, PongTimeout: 50 * time.Millisecond, DisablePings: true}
+		for _, opt := range testDialOptions(t, relay) {
+			opt(dialer)
+		}
+		conn, err := dialer.DialContext(context.Background(), "tcp", "test-instance:22")
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		relay.BlackHoleConnections()
+		time.Sleep(200 * time.Millisecond)
+		assert.Zero(t, relay.Reconnects(), "an unanswered websocket is not detected without pings")
+		relay.DropConnections() // closing the tunnel would wait for the silenced websocket otherwise
+	})
+
+	t.Run("negative interval", func(t *testing.T) {
+		relay := startRelay(t)
+		dialer := &iap.Dialer{Host: testHost, PingInterval: -time.Second}
+		for _, opt := range testDialOptions(t, relay) {
+			opt(dialer)
+		}
+		_, err := dialer.DialContext(context.Background(), "tcp", "test-instance:22")
+		assert.Error(t, err)
+		assert.Zero(t, relay.ConnectAttempts())
+	})
+}
+
+func TestDialerHTTPTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from " + r.Host))
+	}))
+	t.Cleanup(backend.Close)
+	relay := iaptest.NewRelay(backend.Listener.Addr().String())
+	t.Cleanup(relay.Close)
+
+	log, err := logger.NewZapLogger("error")
+	require.NoError(t, err)
+	dialer := &iap.Dialer{
+		Host:        iap.IAPHost{ProjectID: "test-project", Zone: "us-central1-a"},
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"}),
+		Relay:       iap.RelayConfig{Endpoint: relay.URL},
+		Logger:      log,
+	}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	t.Cleanup(transport.CloseIdleConnections)
+
+	res, err := (&http.Client{Transport: transport}).Get("http://my-vm:8080/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello from my-vm:8080", string(body))
+
+	query := relay.ConnectQuery()
+	assert.Equal(t, "my-vm", query.Get("instance"))
+	assert.Equal(t, "8080", query.Get("port"))
+	assert.Equal(t, "nic0", query.Get("interface"))
+}
+
+func TestDialerHostMode(t *testing.T) {
+	relay := startRelay(t)
+	dialer := &iap.Dialer{
+		Host: iap.IAPHost{ProjectID: "test-project", Region: "us-central1", Network: "default", DestGroup: "on-prem"},
+	}
+	for _, opt := range testDialOptions(t, relay) {
+		opt(dialer)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "10.1.2.3:5432")
+	require.NoError(t, err)
+	conn.Close()
+
+	query := relay.ConnectQuery()
+	assert.Equal(t, "10.1.2.3", query.Get("host"))
+	assert.Equal(t, "5432", query.Get("port"))
+	assert.Empty(t, query.Get("interface"))
+
+	_, err = dialer.DialContext(context.Background(), "udp", "10.1.2.3:53")
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package iap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/coder/websocket"
+)
+
+var (
+	// ErrNotAuthorized is returned when the caller lacks permission to tunnel to the target,
+	// e.g. the IAP-secured Tunnel User role is missing.
+	ErrNotAuthorized = errors.New("not authorized to connect to the target")
+	// ErrBackendUnreachable is returned when the relay can not connect to the target port,
+	// e.g. the instance is stopped or a firewall rule blocks the IAP range.
+	ErrBackendUnreachable = errors.New("failed to connect to backend")
+	// ErrLookupFailed is returned when the relay can not find the target instance.
+	ErrLookupFailed = errors.New("target lookup failed")
+	// ErrReauthRequired is returned when the relay requires a fresh access token.
+	ErrReauthRequired = errors.New("reauthentication required")
+	// ErrSessionLost is returned when the relay does not recognize the session on reconnect.
+	ErrSessionLost = errors.New("session is unknown or already in use")
+	// ErrProtocol is returned when either side violates the SSH Relay v4 protocol.
+	ErrProtocol = errors.New("relay protocol error")
+	// ErrRelay is returned for any other relay failure.
+	ErrRelay = errors.New("relay error")
+	// ErrPingTimeout is returned when the relay does not answer a websocket ping in time and the session
+	// can not be resumed. It wraps the error which prevented resuming the session.
+	ErrPingTimeout = errors.New("relay did not answer ping")
+	// ErrSessionHung is returned when the relay reports a hung session and the session can not be resumed.
+	// It wraps the error which prevented resuming the session.
+	ErrSessionHung = errors.New("relay session hung")
+	// ErrIdleTimeout is returned when the tunnel was closed because no data was sent or received for the idle timeout.
+	ErrIdleTimeout = errors.New("tunnel idle timeout")
+)
+
+// closeStatusErrors maps IAP specific websocket close codes to sentinel errors.
+var closeStatusErrors = map[websocket.StatusCode]error{
+	CloseStatusErrorUnknown:             ErrRelay,
+	CloseStatusSIDUnknown:               ErrSessionLost,
+	CloseStatusSIDInUse:                 ErrSessionLost,
+	CloseStatusFailedToConnectToBackend: ErrBackendUnreachable,
+	CloseStatusReauthenticationRequired: ErrReauthRequired,
+	CloseStatusBadACK:                   ErrProtocol,
+	CloseStatusInvalidACK:               ErrProtocol,
+	CloseStatusInvalidSocketOpcode:      ErrProtocol,
+	CloseStatusInvalidTag:               ErrProtocol,
+	CloseStatusDestinationWriteFailed:   ErrBackendUnreachable,
+	CloseStatusDestinationReadFailed:    ErrBackendUnreachable, // end of stream once the session is established
+	CloseStatusInvalidData:              ErrProtocol,
+	CloseStatusNotAuthorized:            ErrNotAuthorized,
+	CloseStatusLookupFailed:             ErrLookupFailed,
+	CloseStatusLookupFailedReconnect:    ErrLookupFailed,
+	CloseStatusFailedToRewind:           ErrSessionLost,
+}
+
+// CloseError is returned when the relay closes the websocket with an IAP specific status code.
+// It unwraps to one of the sentinel errors, so callers can use errors.Is to classify the failure.
+type CloseError struct {
+	Code   websocket.StatusCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("%s (%d)", e.Unwrap(), e.Code)
+	}
+	return fmt.Sprintf("%s (%d): %s", e.Unwrap(), e.Code, e.Reason)
+}
+
+// Unwrap returns the sentinel error matching the close code.
+func (e *CloseError) Unwrap() error {
+	if err, ok := closeStatusErrors[e.Code]; ok {
+		return err
+	}
+	return ErrRelay
+}
+
+// HandshakeError is returned when the relay rejects the websocket upgrade request with an HTTP error.
+type HandshakeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("relay handshake failed with HTTP %d: %v", e.StatusCode, e.Err)
+}
+
+// Unwrap returns the sentinel error matching the HTTP status together with the underlying dial error.
+func (e *HandshakeError) Unwrap() []error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return []error{ErrNotAuthorized, e.Err}
+	case http.StatusNotFound:
+		return []error{ErrLookupFailed, e.Err}
+	default:
+		return []error{ErrRelay, e.Err}
+	}
+}
+
+// relayError converts websocket close and handshake errors into typed IAP errors.
+// Other errors, including normal closure, are returned unchanged.
+func relayError(err error, res *http.Response) error {
+	if err == nil {
+		return nil
+	}
+
+	var closeErr websocket.CloseError
+	if errors.As(err, &closeErr) {
+		if _, ok := closeStatusErrors[closeErr.Code]; ok {
+			return &CloseError{Code: closeErr.Code, Reason: closeErr.Reason}
+		}
+		return err
+	}
+
+	if res != nil && res.StatusCode != http.StatusSwitchingProtocols {
+		return &HandshakeError{StatusCode: res.StatusCode, Err: err}
+	}
+
+	return err
+}
+
+// closeReason truncates the reason to fit into a websocket close frame.
+func closeReason(reason string) string {
+	if len(reason) > maxCloseReasonLen {
+		return reason[:maxCloseReasonLen]
+	}
+	return reason
+}
@@ -0,0 +1,59 @@
+package iap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayErrorFromCloseStatus(t *testing.T) {
+	cases := []struct {
+		code     websocket.StatusCode
+		sentinel error
+	}{
+		{CloseStatusNotAuthorized, ErrNotAuthorized},
+		{CloseStatusFailedToConnectToBackend, ErrBackendUnreachable},
+		{CloseStatusLookupFailed, ErrLookupFailed},
+		{CloseStatusReauthenticationRequired, ErrReauthRequired},
+		{CloseStatusSIDUnknown, ErrSessionLost},
+		{CloseStatusInvalidData, ErrProtocol},
+	}
+
+	for _, tc := range cases {
+		wsErr := fmt.Errorf("failed to read frame: %w", websocket.CloseError{Code: tc.code, Reason: "test"})
+		err := relayError(wsErr, nil)
+		assert.ErrorIs(t, err, tc.sentinel)
+
+		var closeErr *CloseError
+		if assert.ErrorAs(t, err, &closeErr) {
+			assert.Equal(t, tc.code, closeErr.Code)
+		}
+	}
+}
+
+func TestRelayErrorKeepsUnknownErrors(t *testing.T) {
+	normal := websocket.CloseError{Code: websocket.StatusNormalClosure}
+	assert.Equal(t, error(normal), relayError(normal, nil))
+
+	other := errors.New("connection reset")
+	assert.Equal(t, other, relayError(other, nil))
+	assert.Nil(t, relayError(nil, nil))
+}
+
+func TestRelayErrorFromHandshake(t *testing.T) {
+	dialErr := errors.New("expected handshake response status code 101")
+
+	err := relayError(dialErr, &http.Response{StatusCode: http.StatusForbidden})
+	assert.ErrorIs(t, err, ErrNotAuthorized)
+	assert.ErrorIs(t, err, dialErr)
+
+	err = relayError(dialErr, &http.Response{StatusCode: http.StatusNotFound})
+	assert.ErrorIs(t, err, ErrLookupFailed)
+
+	err = relayError(dialErr, &http.Response{StatusCode: http.StatusBadGateway})
+	assert.ErrorIs(t, err, ErrRelay)
+}
@@ -3,120 +3,277 @@ package iap
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/coder/websocket"
 	"github.com/nicksulia/go-tcp-over-google-iap/logger"
 )
 
-// IncomingFrame represents an incoming frame used in the IAP tunnel protocol.
-// It contains the raw data of the frame and provides methods to extract information from it.
-// The frame structure is defined by the protocol specification and includes a message TAG, SID, ACK, and data.
-// The frame is expected to be in binary format with specific lengths for each field.
-type IncomingFrame struct {
-	data []byte
+// ErrIncompleteFrame is returned by ParseFrame when the message ends before the frame does.
+// It wraps ErrProtocol, as a single message must hold complete frames. FrameDecoder waits for more data instead.
+var ErrIncompleteFrame = fmt.Errorf("%w: incomplete frame", ErrProtocol)
+
+// Frame is a decoded frame received from the relay.
+// Use a type switch on the concrete frame types to access the payload.
+type Frame interface {
+	// Tag returns the message TAG of the frame.
+	Tag() uint16
+	// Len returns the number of bytes the frame occupies in the message, including the header.
+	Len() int
+}
+
+// ConnectSuccessSIDFrame is sent by the relay once a new session is established.
+// The SID is used to resume the session after the websocket is lost.
+type ConnectSuccessSIDFrame struct {
+	SID string
 }
 
-// NewIncomingFrame creates a new IncomingFrame with the provided message data.
-func NewIncomingFrame(msg []byte) *IncomingFrame {
-	return &IncomingFrame{
-		data: msg,
+func (f *ConnectSuccessSIDFrame) Tag() uint16 { return RelayConnectSuccessSID }
+func (f *ConnectSuccessSIDFrame) Len() int    { return SIDHeaderLen + len(f.SID) }
+
+// ReconnectSuccessACKFrame is sent by the relay once a session is resumed.
+// The ACK is the number of bytes the relay received before the websocket was lost.
+type ReconnectSuccessACKFrame struct {
+	ACK uint64
+}
+
+func (f *ReconnectSuccessACKFrame) Tag() uint16 { return RelayReconnectSuccessACK }
+func (f *ReconnectSuccessACKFrame) Len() int    { return ACKHeaderLen }
+
+// RelayACKFrame confirms the total number of bytes the relay received in the session.
+type RelayACKFrame struct {
+	ACK uint64
+}
+
+func (f *RelayACKFrame) Tag() uint16 { return RelayACK }
+func (f *RelayACKFrame) Len() int    { return ACKHeaderLen }
+
+// RelayDataFrame carries data from the remote host.
+type RelayDataFrame struct {
+	Data []byte
+}
+
+func (f *RelayDataFrame) Tag() uint16 { return RelayData }
+func (f *RelayDataFrame) Len() int    { return DataMessageHeaderLen + len(f.Data) }
+
+// UnknownFrame is a frame with a TAG which is not supported by the client.
+// The length of such frame is unknown, so it spans the rest of the message.
+type UnknownFrame struct {
+	tag     uint16
+	Payload []byte
+}
+
+func (f *UnknownFrame) Tag() uint16 { return f.tag }
+func (f *UnknownFrame) Len() int    { return MessageTagLen + len(f.Payload) }
+
+// ParseFrame decodes the frame at the beginning of msg.
+// It validates the header and the declared lengths, and returns an error wrapping ErrProtocol for malformed frames.
+// Bytes after the frame are not decoded, Frame.Len tells where the next frame starts.
+// The returned frame references msg, it must not be modified while the frame is in use.
+func ParseFrame(msg []byte) (Frame, error) {
+	return parseFrame(msg, nil)
+}
+
+// parseFrame decodes the frame at the beginning of msg. Data frames are decoded into data if it is not nil.
+func parseFrame(msg []byte, data *RelayDataFrame) (Frame, error) {
+	if len(msg) < MessageTagLen {
+		return nil, fmt.Errorf("%w: frame of %d bytes is too short for a message tag", ErrIncompleteFrame, len(msg))
 	}
+
+	tag := binary.BigEndian.Uint16(msg[:MessageTagLen])
+	switch tag {
+	case RelayConnectSuccessSID:
+		if len(msg) < SIDHeaderLen {
+			return nil, fmt.Errorf("%w: connect success frame of %d bytes is too short", ErrIncompleteFrame, len(msg))
+		}
+
+		sidLen := binary.BigEndian.Uint32(msg[MessageTagLen:SIDHeaderLen])
+		if sidLen > MaxMessageSize {
+			return nil, fmt.Errorf("%w: declared SID length %d exceeds maximum of %d bytes", ErrProtocol, sidLen, MaxMessageSize)
+		}
+
+		if uint64(sidLen) > uint64(len(msg)-SIDHeaderLen) {
+			return nil, fmt.Errorf("%w: declared SID length %d exceeds frame payload of %d bytes", ErrIncompleteFrame, sidLen, len(msg)-SIDHeaderLen)
+		}
+
+		return &ConnectSuccessSIDFrame{SID: string(msg[SIDHeaderLen : SIDHeaderLen+int(sidLen)])}, nil
+	case RelayReconnectSuccessACK, RelayACK:
+		if len(msg) < ACKHeaderLen {
+			return nil, fmt.Errorf("%w: ACK frame of %d bytes is too short", ErrIncompleteFrame, len(msg))
+		}
+
+		ack := binary.BigEndian.Uint64(msg[MessageTagLen:ACKHeaderLen])
+		if tag == RelayACK {
+			return &RelayACKFrame{ACK: ack}, nil
+		}
+		return &ReconnectSuccessACKFrame{ACK: ack}, nil
+	case RelayData:
+		if len(msg) < DataMessageHeaderLen {
+			return nil, fmt.Errorf("%w: data frame of %d bytes is too short", ErrIncompleteFrame, len(msg))
+		}
+
+		dataLen := binary.BigEndian.Uint32(msg[MessageTagLen:DataMessageHeaderLen])
+		if dataLen > MaxMessageSize {
+			return nil, fmt.Errorf("%w: declared data length %d exceeds maximum of %d bytes", ErrProtocol, dataLen, MaxMessageSize)
+		}
+
+		if uint64(dataLen) > uint64(len(msg)-DataMessageHeaderLen) {
+			return nil, fmt.Errorf("%w: declared data length %d exceeds frame payload of %d bytes", ErrIncompleteFrame, dataLen, len(msg)-DataMessageHeaderLen)
+		}
+
+		if data == nil {
+			data = &RelayDataFrame{}
+		}
+		data.Data = msg[DataMessageHeaderLen : DataMessageHeaderLen+int(dataLen)]
+		return data, nil
+	default:
+		return &UnknownFrame{tag: tag, Payload: msg[MessageTagLen:]}, nil
+	}
+}
+
+// FrameDecoder decodes a stream of frames from consecutive websocket messages.
+// The relay may pack several frames into one message, or split a frame across messages.
+// Incomplete frames are kept until the rest of the frame arrives.
+// The decoder reuses its buffers, so decoding data frames does not allocate once it is warmed up.
+type FrameDecoder struct {
+	pending []byte
+	joined  []byte           // pending bytes followed by the current message
+	frames  []Frame          // returned by Decode
+	data    []RelayDataFrame // reused data frames
+}
+
+// Decode decodes all complete frames from msg, prefixed with any pending bytes from previous messages.
+// On error the frames decoded before the malformed one are returned along with the error.
+// The returned frames reference msg, it must not be modified while the frames are in use.
+// The returned slice and frames are only valid until the next call to Decode.
+func (d *FrameDecoder) Decode(msg []byte) ([]Frame, error) {
+	buf := msg
+	if len(d.pending) > 0 {
+		d.joined = append(append(d.joined[:0], d.pending...), msg...)
+		d.pending = d.pending[:0]
+		buf = d.joined
+	}
+
+	clear(d.frames)
+	d.frames = d.frames[:0]
+	dataFrames := 0
+	for len(buf) > 0 {
+		if dataFrames == len(d.data) {
+			// Frames returned by earlier calls keep pointing to the previous array, which is fine
+			d.data = append(d.data, RelayDataFrame{})
+			d.data = d.data[:cap(d.data)]
+		}
+
+		frame, err := parseFrame(buf, &d.data[dataFrames])
+		if errors.Is(err, ErrIncompleteFrame) {
+			d.pending = append(d.pending[:0], buf...)
+			return d.frames, nil
+		}
+
+		if err != nil {
+			return d.frames, err
+		}
+
+		if frame == &d.data[dataFrames] {
+			dataFrames++
+		}
+		d.frames = append(d.frames, frame)
+		buf = buf[frame.Len():]
+	}
+
+	return d.frames, nil
 }
 
-// Type returns the TAG of the incoming frame.
-// The TAG is a 2-byte field that indicates the type of message being sent.
-func (f *IncomingFrame) Type() uint16 {
-	tag := binary.BigEndian.Uint16(f.data[:MessageTagLen])
-	return tag
+// Pending returns the number of bytes buffered for an incomplete frame.
+func (d *FrameDecoder) Pending() int {
+	return len(d.pending)
 }
 
-// SID returns the SID (Session ID) of the incoming frame.
-// The SID is a variable-length field that starts after the message TAG and its length.
-// The length of the SID is specified in the frame header, and it is encoded as a 4-byte unsigned integer.
-// The SID is used to identify the session associated with the frame.
-func (f *IncomingFrame) SID() string {
-	sidLen := binary.BigEndian.Uint32(f.data[MessageTagLen:SIDHeaderLen])
-	return string(f.data[SIDHeaderLen : SIDHeaderLen+sidLen])
+// Reset discards any incomplete frame, e.g. after the websocket is replaced.
+func (d *FrameDecoder) Reset() {
+	d.pending = d.pending[:0]
 }
 
-// ACK returns the ACK (Acknowledgment) value of the incoming frame.
-// The ACK is a 64-bit unsigned integer that starts after the message TAG and is used
-// to acknowledge the receipt of data. It is encoded in big-endian format.
-// The ACK value is used to confirm the number of bytes received in the session.
-func (f *IncomingFrame) ACK() uint64 {
-	return binary.BigEndian.Uint64(f.data[MessageTagLen:ACKHeaderLen])
+// writeDataFrame writes a data frame as a single websocket message. The header and the payload are written
+// separately, so the payload is sent without being copied into a frame buffer.
+// hdr is scratch space of at least DataMessageHeaderLen bytes owned by the caller.
+func writeDataFrame(ctx context.Context, ws *websocket.Conn, hdr, payload []byte) error {
+	w, err := ws.Writer(ctx, websocket.MessageBinary)
+	if err != nil {
+		return fmt.Errorf("websocket writer init failure: %w", err)
+	}
+
+	binary.BigEndian.PutUint16(hdr, RelayData)
+	binary.BigEndian.PutUint32(hdr[MessageTagLen:], uint32(len(payload)))
+	if _, err = w.Write(hdr[:DataMessageHeaderLen]); err == nil {
+		_, err = w.Write(payload)
+	}
+
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-// Data returns the data payload of the incoming frame.
-// The data payload is a variable-length field that starts after the message TAG and the message length.
-// The length of the data payload is specified in the frame header as a 4-byte unsigned integer
-func (f *IncomingFrame) Data() ([]byte, []byte) {
-	msgLen := binary.BigEndian.Uint32(f.data[MessageTagLen:DataMessageHeaderLen])
-	fullPayload := f.data[DataMessageHeaderLen:]
-	return fullPayload[:msgLen], fullPayload[msgLen:]
+// writeACKFrame writes an ACK frame as a single websocket message.
+// hdr is scratch space of at least ACKHeaderLen bytes owned by the caller.
+func writeACKFrame(ctx context.Context, ws *websocket.Conn, hdr []byte, ack uint64) error {
+	binary.BigEndian.PutUint16(hdr, RelayACK)
+	binary.BigEndian.PutUint64(hdr[MessageTagLen:], ack)
+	return ws.Write(ctx, websocket.MessageBinary, hdr[:ACKHeaderLen])
 }
 
 // ACKFrame represents an ACK frame used in the IAP tunnel protocol.
+//
+// Deprecated: IAPTunnel acknowledges received data itself. Send is kept for compatibility and encodes the frame
+// the same way the tunnel does.
 type ACKFrame struct {
-	frame  []byte
-	ackVal uint64
+	ack    uint64
 	logger logger.Logger
 }
 
 // Send sends the ACK frame over the provided WebSocket connection.
 func (f *ACKFrame) Send(conn *websocket.Conn) (int, error) {
-	writer, err := conn.Writer(context.Background(), websocket.MessageBinary)
-	if err != nil {
-		return 0, fmt.Errorf("websocket writer init failure: %w", err)
+	err := writeACKFrame(context.Background(), conn, make([]byte, ACKHeaderLen), f.ack)
+	if f.logger != nil {
+		f.logger.Debug("Send ACK frame", "ack", f.ack)
 	}
-	defer writer.Close()
-	written, err := writer.Write(f.frame)
-	dataWritten := written - ACKHeaderLen
-	f.logger.Debug("Send ACK frame", "frame size", len(f.frame), "binary_data", f.frame)
-
-	return dataWritten, err
+	return 0, err
 }
 
 // NewACKFrame creates a new ACK frame with the specified inbound data length.
+//
+// Deprecated: IAPTunnel acknowledges received data itself.
 func NewACKFrame(inboundDataLen uint64, logger logger.Logger) *ACKFrame {
-	ackFrame := &ACKFrame{
-		ackVal: inboundDataLen,
-		logger: logger,
-	}
-	ackFrame.frame = make([]byte, ACKHeaderLen)
-	binary.BigEndian.PutUint16(ackFrame.frame[0:], RelayACK)
-	binary.BigEndian.PutUint64(ackFrame.frame[MessageTagLen:], inboundDataLen)
-	return ackFrame
+	return &ACKFrame{ack: inboundDataLen, logger: logger}
 }
 
 // DataFrame represents a data frame used in the IAP tunnel protocol.
+//
+// Deprecated: use IAPTunnel.Write, which splits data into frames, resends them after a reconnect and respects the
+// send window. Send is kept for compatibility and encodes the frame the same way the tunnel does.
 type DataFrame struct {
-	frame  []byte
+	data   []byte
 	logger logger.Logger
 }
 
 // Send sends the data frame over the provided WebSocket connection.
+// It returns the number of payload bytes sent.
 func (f *DataFrame) Send(conn *websocket.Conn) (int, error) {
-	writer, err := conn.Writer(context.Background(), websocket.MessageBinary)
+	err := writeDataFrame(context.Background(), conn, make([]byte, DataMessageHeaderLen), f.data)
+	if f.logger != nil {
+		f.logger.Debug("Send Data frame", "frame size", DataMessageHeaderLen+len(f.data))
+	}
 	if err != nil {
-		return 0, fmt.Errorf("websocket writer init failure: %w", err)
+		return 0, err
 	}
-	defer writer.Close()
-	written, err := writer.Write(f.frame)
-	f.logger.Debug("Send Data frame", "frame size", len(f.frame), "bytes_to_send[:20]", f.frame[:20])
-	dataWritten := written - DataMessageHeaderLen
-	return dataWritten, err
+	return len(f.data), nil
 }
 
 // NewDataFrame creates a new DataFrame with the provided data.
+//
+// Deprecated: use IAPTunnel.Write.
 func NewDataFrame(sendData []byte, logger logger.Logger) *DataFrame {
-	dataFrame := &DataFrame{
-		logger: logger,
-	}
-	dataFrame.frame = make([]byte, DataMessageHeaderLen+len(sendData))
-	binary.BigEndian.PutUint16(dataFrame.frame[0:], RelayData)
-	binary.BigEndian.PutUint32(dataFrame.frame[MessageTagLen:], uint32(len(sendData)))
-	copy(dataFrame.frame[DataMessageHeaderLen:], sendData)
-	return dataFrame
+	return &DataFrame{data: append([]byte(nil), sendData...), logger: logger}
 }
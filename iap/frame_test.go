@@ -0,0 +1,166 @@
+package iap
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ackFrame encodes an ACK frame the way the relay sends it.
+func ackFrame(ack uint64) []byte {
+	frame := make([]byte, ACKHeaderLen)
+	binary.BigEndian.PutUint16(frame, RelayACK)
+	binary.BigEndian.PutUint64(frame[MessageTagLen:], ack)
+	return frame
+}
+
+// dataFrame encodes a data frame the way the relay sends it.
+func dataFrame(payload []byte) []byte {
+	frame := make([]byte, DataMessageHeaderLen, DataMessageHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(frame, RelayData)
+	binary.BigEndian.PutUint32(frame[MessageTagLen:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestParseFrame(t *testing.T) {
+	sid := []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x03, 'a', 'b', 'c'}
+	frame, err := ParseFrame(sid)
+	assert.NoError(t, err)
+	assert.Equal(t, &ConnectSuccessSIDFrame{SID: "abc"}, frame)
+	assert.Equal(t, len(sid), frame.Len())
+
+	frame, err = ParseFrame(ackFrame(42))
+	assert.NoError(t, err)
+	assert.Equal(t, &RelayACKFrame{ACK: 42}, frame)
+
+	reconnect := ackFrame(7)
+	binary.BigEndian.PutUint16(reconnect, RelayReconnectSuccessACK)
+	frame, err = ParseFrame(reconnect)
+	assert.NoError(t, err)
+	assert.Equal(t, &ReconnectSuccessACKFrame{ACK: 7}, frame)
+
+	data := dataFrame([]byte("hello"))
+	frame, err = ParseFrame(append(data, 0xff))
+	assert.NoError(t, err)
+	assert.Equal(t, &RelayDataFrame{Data: []byte("hello")}, frame)
+	assert.Equal(t, len(data), frame.Len(), "trailing bytes are not part of the frame")
+
+	frame, err = ParseFrame([]byte{0x00, 0x09, 0x01})
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(9), frame.Tag())
+	assert.IsType(t, &UnknownFrame{}, frame)
+}
+
+func TestParseMalformedFrame(t *testing.T) {
+	oversized := make([]byte, DataMessageHeaderLen)
+	binary.BigEndian.PutUint16(oversized, RelayData)
+	binary.BigEndian.PutUint32(oversized[MessageTagLen:], MaxMessageSize+1)
+
+	cases := map[string][]byte{
+		"empty":              {},
+		"tag only":           {0x00},
+		"short SID header":   {0x00, 0x01, 0x00},
+		"SID length":         {0x00, 0x01, 0x00, 0x00, 0x00, 0x05, 'a'},
+		"short ACK":          {0x00, 0x07, 0x00, 0x00},
+		"short data header":  {0x00, 0x04, 0x00, 0x00, 0x00},
+		"data length":        {0x00, 0x04, 0x00, 0x00, 0x00, 0x02, 'a'},
+		"data exceeds limit": oversized,
+	}
+
+	for name, msg := range cases {
+		_, err := ParseFrame(msg)
+		assert.ErrorIs(t, err, ErrProtocol, name)
+	}
+}
+
+func TestFrameDecoderConcatenatedFrames(t *testing.T) {
+	msg := append(dataFrame([]byte("hello")), ackFrame(42)...)
+	msg = append(msg, dataFrame([]byte("world"))...)
+
+	var decoder FrameDecoder
+	frames, err := decoder.Decode(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, []Frame{
+		&RelayDataFrame{Data: []byte("hello")},
+		&RelayACKFrame{ACK: 42},
+		&RelayDataFrame{Data: []byte("world")},
+	}, frames)
+	assert.Zero(t, decoder.Pending())
+}
+
+func TestFrameDecoderSplitFrames(t *testing.T) {
+	stream := append(dataFrame([]byte("hello world")), ackFrame(42)...)
+
+	var decoder FrameDecoder
+	// Split inside the data header, inside the payload and inside the ACK
+	frames, err := decoder.Decode(stream[:3])
+	assert.NoError(t, err)
+	assert.Empty(t, frames)
+	assert.Equal(t, 3, decoder.Pending())
+
+	frames, err = decoder.Decode(stream[3:10])
+	assert.NoError(t, err)
+	assert.Empty(t, frames)
+
+	frames, err = decoder.Decode(stream[10:20])
+	assert.NoError(t, err)
+	assert.Equal(t, []Frame{&RelayDataFrame{Data: []byte("hello world")}}, frames)
+	assert.Equal(t, 3, decoder.Pending())
+
+	frames, err = decoder.Decode(stream[20:])
+	assert.NoError(t, err)
+	assert.Equal(t, []Frame{&RelayACKFrame{ACK: 42}}, frames)
+	assert.Zero(t, decoder.Pending())
+}
+
+func TestFrameDecoderMalformedFrame(t *testing.T) {
+	oversized := make([]byte, DataMessageHeaderLen)
+	binary.BigEndian.PutUint16(oversized, RelayData)
+	binary.BigEndian.PutUint32(oversized[MessageTagLen:], MaxMessageSize+1)
+
+	var decoder FrameDecoder
+	frames, err := decoder.Decode(append(ackFrame(1), oversized...))
+	assert.ErrorIs(t, err, ErrProtocol)
+	assert.NotErrorIs(t, err, ErrIncompleteFrame)
+	assert.Equal(t, []Frame{&RelayACKFrame{ACK: 1}}, frames, "frames before the malformed one are returned")
+}
+
+func TestDeprecatedFrameSend(t *testing.T) {
+	messages := make(chan []byte, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			_, msg, err := ws.Read(r.Context())
+			if err != nil {
+				return
+			}
+			messages <- msg
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.CloseNow() })
+
+	n, err := NewDataFrame([]byte("hello"), nil).Send(ws)
+	require.NoError(t, err)
+	assert.Equal(t, len("hello"), n)
+	assert.Equal(t, dataFrame([]byte("hello")), <-messages)
+
+	n, err = NewACKFrame(42, nil).Send(ws)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, ackFrame(42), <-messages)
+}
@@ -1,53 +1,149 @@
 package iap
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/url"
 
 	mapstructure "github.com/go-viper/mapstructure/v2"
 )
 
 // IAPHost represents the configuration for connecting to a Google Cloud IAP tunnel.
+//
+// The target is either a GCE instance (Zone, Instance and Interface) or, in host mode, an IP address or FQDN
+// reachable through an IAP destination group (Region, Network, DestGroup and Host). The modes are exclusive.
 type IAPHost struct {
 	ProjectID    string `mapstructure:"project"`
-	Zone         string `mapstructure:"zone"`
-	Instance     string `mapstructure:"instance"`
-	Interface    string `mapstructure:"interface"`
+	Zone         string `mapstructure:"zone,omitempty"`
+	Instance     string `mapstructure:"instance,omitempty"`
+	Interface    string `mapstructure:"interface,omitempty"`
+	Region       string `mapstructure:"region,omitempty"`
+	Network      string `mapstructure:"network,omitempty"`
+	DestGroup    string `mapstructure:"group,omitempty"`
+	Host         string `mapstructure:"host,omitempty"`
 	Port         string `mapstructure:"port"`
 	NewWebsocket string `mapstructure:"newWebsocket,omitempty"`
 }
 
+// IAPAddr is the synthetic network address of an IAP destination, e.g. "my-project/us-central1-a/my-vm:22" for
+// an instance or "my-project/us-central1/on-prem/10.10.0.5:22" for a host in a destination group.
+type IAPAddr struct {
+	Host IAPHost
+}
+
+// Network returns "iap".
+func (a *IAPAddr) Network() string {
+	return "iap"
+}
+
+func (a *IAPAddr) String() string {
+	h := a.Host
+	if h.IsHostMode() {
+		return h.ProjectID + "/" + h.Region + "/" + h.DestGroup + "/" + net.JoinHostPort(h.Host, h.Port)
+	}
+	return h.ProjectID + "/" + h.Zone + "/" + net.JoinHostPort(h.Instance, h.Port)
+}
+
 type reconnectParams struct {
 	Ack          string `mapstructure:"ack"`
 	Sid          string `mapstructure:"sid"`
-	Zone         string `mapstructure:"zone"`
+	Zone         string `mapstructure:"zone,omitempty"`
+	Region       string `mapstructure:"region,omitempty"`
 	NewWebsocket string `mapstructure:"newWebsocket"`
 }
 
+// IsHostMode reports whether the target is a destination group host rather than a GCE instance.
+func (h *IAPHost) IsHostMode() bool {
+	return h.Host != ""
+}
+
+// Validate checks that the host describes exactly one kind of target with all required fields.
+func (h *IAPHost) Validate() error {
+	if h.ProjectID == "" {
+		return errors.New("project is required")
+	}
+
+	if h.Port == "" {
+		return errors.New("port is required")
+	}
+
+	instanceMode := h.Zone != "" || h.Instance != ""
+	hostMode := h.Region != "" || h.Network != "" || h.DestGroup != "" || h.Host != ""
+	switch {
+	case instanceMode && hostMode:
+		return errors.New("zone and instance can not be combined with region, network, destination group or host")
+	case hostMode:
+		if h.Region == "" || h.Network == "" || h.DestGroup == "" || h.Host == "" {
+			return errors.New("host mode requires region, network, destination group and host")
+		}
+		if h.Interface != "" {
+			return errors.New("interface can not be combined with host mode")
+		}
+	default:
+		if h.Zone == "" || h.Instance == "" {
+			return errors.New("zone and instance are required")
+		}
+	}
+
+	return nil
+}
+
 // ConnectURI generates the URI for establishing a new connection to the IAP tunnel.
 func (h *IAPHost) ConnectURI() string {
-	h.NewWebsocket = "True"
-	return tunnelURI(ConnectPath, &h)
+	return h.connectURI(defaultRelayEndpoint())
 }
 
 // ReconnectURI is intended to restore existing session
 func (h *IAPHost) ReconnectURI(sid string, ack uint64) string {
-	return tunnelURI(ReconnectPath, &reconnectParams{
+	return h.reconnectURI(defaultRelayEndpoint(), sid, ack)
+}
+
+// connectURI builds the query from a copy, so the host can be read concurrently, e.g. by RemoteAddr.
+func (h *IAPHost) connectURI(endpoint *url.URL) string {
+	hc := *h
+	hc.NewWebsocket = "True"
+	return tunnelURI(endpoint, ConnectPath, &hc)
+}
+
+func (h *IAPHost) reconnectURI(endpoint *url.URL, sid string, ack uint64) string {
+	return tunnelURI(endpoint, ReconnectPath, &reconnectParams{
 		Ack:          fmt.Sprintf("%d", ack),
 		Sid:          sid,
 		Zone:         h.Zone,
+		Region:       h.Region,
 		NewWebsocket: "True",
 	})
 }
 
-func tunnelURI(path string, src any) string {
-	u := url.URL{
-		Scheme:   WebSocketProtocol,
-		Host:     IAPHostURL,
-		Path:     path,
-		RawQuery: queryParams(src).Encode(),
+// defaultRelayEndpoint returns the base URL of the public IAP relay.
+func defaultRelayEndpoint() *url.URL {
+	return &url.URL{Scheme: WebSocketProtocol, Host: IAPHostURL}
+}
+
+// parseRelayEndpoint validates a custom relay base URL, e.g. "wss://tunnel.example.com" or "ws://127.0.0.1:8080".
+func parseRelayEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay endpoint %q: %w", endpoint, err)
+	}
+
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("invalid relay endpoint %q: scheme must be ws or wss", endpoint)
 	}
 
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid relay endpoint %q: host is empty", endpoint)
+	}
+
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u, nil
+}
+
+func tunnelURI(endpoint *url.URL, path string, src any) string {
+	u := endpoint.JoinPath(path)
+	u.RawQuery = queryParams(src).Encode()
 	return u.String()
 }
 
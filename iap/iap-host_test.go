@@ -16,7 +16,7 @@ func TestCreateConnectURI(t *testing.T) {
 		Interface: "nic0",
 	}
 
-	expectedURI := "wss://tunnel.cloudproxy.app/v4/connect?instance=test-instance&interface=nic0&port=8080&project=test-project&zone=us-central1-a"
+	expectedURI := "wss://tunnel.cloudproxy.app/v4/connect?instance=test-instance&interface=nic0&newWebsocket=True&port=8080&project=test-project&zone=us-central1-a"
 	assert.Equal(t, expectedURI, host.ConnectURI())
 }
 
@@ -28,7 +28,7 @@ func TestCreateReconnectURI(t *testing.T) {
 	sid := "12345"
 	ack := uint64(67890)
 
-	expectedURI := "wss://tunnel.cloudproxy.app/v4/reconnect?ack=67890&sid=12345&zone=us-central1-a"
+	expectedURI := "wss://tunnel.cloudproxy.app/v4/reconnect?ack=67890&newWebsocket=True&sid=12345&zone=us-central1-a"
 	assert.Equal(t, expectedURI, host.ReconnectURI(sid, ack))
 }
 
@@ -51,3 +51,61 @@ func TestQueryParams(t *testing.T) {
 
 	assert.Equal(t, expectedParams, queryParams(host))
 }
+
+func TestHostModeURIs(t *testing.T) {
+	host := IAPHost{
+		ProjectID: "test-project",
+		Region:    "us-central1",
+		Network:   "default",
+		DestGroup: "on-prem",
+		Host:      "10.1.2.3",
+		Port:      "22",
+	}
+
+	expectedURI := "wss://tunnel.cloudproxy.app/v4/connect?group=on-prem&host=10.1.2.3&network=default&newWebsocket=True&port=22&project=test-project&region=us-central1"
+	assert.Equal(t, expectedURI, host.ConnectURI())
+
+	expectedURI = "wss://tunnel.cloudproxy.app/v4/reconnect?ack=10&newWebsocket=True&region=us-central1&sid=abc"
+	assert.Equal(t, expectedURI, host.ReconnectURI("abc", 10))
+}
+
+func TestIAPAddr(t *testing.T) {
+	addr := &IAPAddr{Host: IAPHost{ProjectID: "test-project", Zone: "us-central1-a", Instance: "vm", Interface: "nic0", Port: "22"}}
+	assert.Equal(t, "iap", addr.Network())
+	assert.Equal(t, "test-project/us-central1-a/vm:22", addr.String())
+
+	addr.Host = IAPHost{ProjectID: "test-project", Region: "us-central1", Network: "default", DestGroup: "on-prem", Host: "fd00::1", Port: "22"}
+	assert.Equal(t, "test-project/us-central1/on-prem/[fd00::1]:22", addr.String())
+}
+
+func TestValidateHost(t *testing.T) {
+	instance := IAPHost{ProjectID: "p", Zone: "us-central1-a", Instance: "vm", Interface: "nic0", Port: "22"}
+	assert.NoError(t, instance.Validate())
+	assert.False(t, instance.IsHostMode())
+
+	host := IAPHost{ProjectID: "p", Region: "us-central1", Network: "default", DestGroup: "group", Host: "db.internal", Port: "5432"}
+	assert.NoError(t, host.Validate())
+	assert.True(t, host.IsHostMode())
+
+	invalid := map[string]IAPHost{
+		"missing project":        {Zone: "us-central1-a", Instance: "vm", Port: "22"},
+		"missing port":           {ProjectID: "p", Zone: "us-central1-a", Instance: "vm"},
+		"missing instance":       {ProjectID: "p", Zone: "us-central1-a", Port: "22"},
+		"missing target":         {ProjectID: "p", Port: "22"},
+		"missing dest group":     {ProjectID: "p", Region: "us-central1", Network: "default", Host: "10.1.2.3", Port: "22"},
+		"mixed modes":            {ProjectID: "p", Zone: "us-central1-a", Instance: "vm", Region: "us-central1", Network: "default", DestGroup: "g", Host: "10.1.2.3", Port: "22"},
+		"interface in host mode": {ProjectID: "p", Interface: "nic0", Region: "us-central1", Network: "default", DestGroup: "g", Host: "10.1.2.3", Port: "22"},
+	}
+	for name, h := range invalid {
+		assert.Error(t, h.Validate(), name)
+	}
+}
+
+func TestNewIAPTunnelClientHostMode(t *testing.T) {
+	client, err := NewIAPTunnelClient(IAPHost{ProjectID: "p", Region: "us-central1", Network: "default", DestGroup: "g", Host: "10.1.2.3", Port: "22"}, "")
+	assert.NoError(t, err)
+	assert.Empty(t, client.host.Interface, "interface must not be defaulted in host mode")
+
+	_, err = NewIAPTunnelClient(IAPHost{ProjectID: "p", Zone: "us-central1-a", Port: "22", Region: "us-central1"}, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package iaptest
+
+import (
+	"net"
+	"sync"
+)
+
+// blackHoleListener tracks accepted connections, so they can be black-holed.
+type blackHoleListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	conns map[*blackHoleConn]struct{}
+}
+
+func newBlackHoleListener(lis net.Listener) *blackHoleListener {
+	return &blackHoleListener{
+		Listener: lis,
+		conns:    make(map[*blackHoleConn]struct{}),
+	}
+}
+
+func (l *blackHoleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &blackHoleConn{Conn: conn, listener: l, closed: make(chan struct{})}
+	l.mu.Lock()
+	l.conns[c] = struct{}{}
+	l.mu.Unlock()
+	return c, nil
+}
+
+// blackHole silences every open connection.
+func (l *blackHoleListener) blackHole() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for c := range l.conns {
+		c.silence()
+	}
+}
+
+func (l *blackHoleListener) remove(c *blackHoleConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, c)
+}
+
+// blackHoleConn is a connection which can be silenced as a black-holed network would: reads block until the
+// connection is closed and writes are discarded, so the peer neither receives data nor an error.
+type blackHoleConn struct {
+	net.Conn
+	listener *blackHoleListener
+
+	mu        sync.Mutex
+	silent    bool
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *blackHoleConn) silence() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.silent = true
+}
+
+func (c *blackHoleConn) isSilent() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.silent
+}
+
+func (c *blackHoleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.isSilent() {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *blackHoleConn) Write(p []byte) (int, error) {
+	if c.isSilent() {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *blackHoleConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.listener.remove(c)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,664 @@
+// Package iaptest provides a fake IAP relay for testing tunnels without Google Cloud.
+//
+// The Relay is a local websocket server speaking the SSH Relay v4 subprotocol. Every session is forwarded
+// to a single local TCP backend. Sessions survive dropped websockets and can be resumed via /v4/reconnect,
+// the same way the real relay does. Faults such as dropped or black-holed connections, IAP close codes,
+// expired access tokens, delayed ACKs and malformed frames can be triggered from tests.
+//
+// Example:
+//
+//	relay := iaptest.NewRelay(backend.Addr().String())
+//	defer relay.Close()
+//	tunnel := iap.NewIAPTunnel(host, tokenSource, logger)
+//	tunnel.SetRelayEndpoint(relay.URL)
+//	tunnel.Start(ctx)
+//	relay.DropConnections() // the tunnel resumes the session transparently
+package iaptest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/nicksulia/go-tcp-over-google-iap/iap"
+)
+
+// Relay is a fake IAP relay which forwards every session to a local TCP backend.
+type Relay struct {
+	// URL is the base URL of the relay in the form ws://127.0.0.1:port, to be passed to SetRelayEndpoint.
+	URL string
+
+	server     *httptest.Server
+	listener   *blackHoleListener
+	backend    string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	attempts   atomic.Int32
+	connects   atomic.Int32
+	reconnects atomic.Int32
+
+	mu           sync.Mutex
+	sessions     map[string]*session
+	rejectCode   websocket.StatusCode
+	failConnects int                  // number of connect requests which still fail
+	failStatus   int                  // HTTP status of the failing connect requests, if not closed with failCode
+	failCode     websocket.StatusCode // close code of the failing connect requests
+	ackDelay     time.Duration
+	backendClose websocket.StatusCode // close code once the backend ends the stream, zero for a normal closure
+	lastQuery    url.Values
+	lastToken    string
+	tokens       map[string]bool // access tokens seen by the relay, true once expired
+}
+
+// NewRelay starts a relay which forwards sessions to the TCP backend at addr.
+// The caller should call Close when finished, to shut it down.
+func NewRelay(addr string) *Relay {
+	r := newRelay(addr)
+	r.server.Start()
+	r.URL = "ws://" + strings.TrimPrefix(r.server.URL, "http://")
+	return r
+}
+
+// NewTLSRelay starts a relay using TLS with a self-signed certificate, see Certificate.
+// The caller should call Close when finished, to shut it down.
+func NewTLSRelay(addr string) *Relay {
+	r := newRelay(addr)
+	r.server.StartTLS()
+	r.URL = "wss://" + strings.TrimPrefix(r.server.URL, "https://")
+	return r
+}
+
+// NewMTLSRelay starts a TLS relay which requires clients to present a certificate signed by one of clientCAs.
+// The caller should call Close when finished, to shut it down.
+func NewMTLSRelay(addr string, clientCAs *x509.CertPool) *Relay {
+	r := newRelay(addr)
+	r.server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	r.server.StartTLS()
+	r.URL = "wss://" + strings.TrimPrefix(r.server.URL, "https://")
+	return r
+}
+
+func newRelay(addr string) *Relay {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Relay{
+		backend:  addr,
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: make(map[string]*session),
+		tokens:   make(map[string]bool),
+	}
+	r.server = httptest.NewUnstartedServer(r)
+	r.listener = newBlackHoleListener(r.server.Listener)
+	r.server.Listener = r.listener
+	return r
+}
+
+// Certificate returns the certificate of a TLS relay, or nil if the relay does not use TLS.
+func (r *Relay) Certificate() *x509.Certificate {
+	return r.server.Certificate()
+}
+
+// Close shuts down the relay and closes all sessions.
+func (r *Relay) Close() {
+	r.cancel()
+	for _, s := range r.activeSessions() {
+		s.close(websocket.StatusGoingAway, "relay shutting down")
+	}
+	r.server.Close()
+}
+
+// ConnectAttempts returns the number of connect requests, including failed and rejected ones.
+func (r *Relay) ConnectAttempts() int {
+	return int(r.attempts.Load())
+}
+
+// Connects returns the number of new sessions accepted by the relay.
+func (r *Relay) Connects() int {
+	return int(r.connects.Load())
+}
+
+// Reconnects returns the number of resumed sessions.
+func (r *Relay) Reconnects() int {
+	return int(r.reconnects.Load())
+}
+
+// ConnectQuery returns the query parameters of the last connect request, which describe the target.
+func (r *Relay) ConnectQuery() url.Values {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastQuery
+}
+
+// LastToken returns the access token of the last connect or reconnect request.
+func (r *Relay) LastToken() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastToken
+}
+
+// ExpireTokens expires every access token the relay has seen so far. Open websockets are closed with
+// iap.CloseStatusReauthenticationRequired and new websockets authenticated with an expired token are closed the
+// same way, so clients have to reconnect with a fresh token. Sessions are kept, so clients can resume them.
+func (r *Relay) ExpireTokens() {
+	r.mu.Lock()
+	for token := range r.tokens {
+		r.tokens[token] = true
+	}
+	r.mu.Unlock()
+	r.CloseConnections(iap.CloseStatusReauthenticationRequired, "access token expired")
+}
+
+// DropConnections abruptly closes every websocket without a close frame, as a network failure would.
+// Sessions are kept, so clients can resume them.
+func (r *Relay) DropConnections() {
+	for _, s := range r.activeSessions() {
+		if ws := s.getWS(); ws != nil {
+			ws.CloseNow()
+		}
+	}
+}
+
+// CloseConnections closes every websocket with the given status code, e.g. iap.CloseStatusReauthenticationRequired.
+// Sessions are kept, so clients can resume them.
+func (r *Relay) CloseConnections(code websocket.StatusCode, reason string) {
+	for _, s := range r.activeSessions() {
+		if ws := s.getWS(); ws != nil {
+			ws.Close(code, reason)
+		}
+	}
+}
+
+// BlackHoleConnections silences every open connection without closing it, as a black-holed network would.
+// The relay neither reads from nor writes to them anymore, so pings are not answered. Sessions are kept,
+// so clients can resume them over new connections.
+func (r *Relay) BlackHoleConnections() {
+	r.listener.blackHole()
+}
+
+// RejectConnections makes the relay close every new websocket with the given status code right after the handshake,
+// e.g. iap.CloseStatusNotAuthorized or iap.CloseStatusFailedToConnectToBackend. Zero accepts connections again.
+func (r *Relay) RejectConnections(code websocket.StatusCode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rejectCode = code
+}
+
+// FailConnects makes the next n connect requests fail with the HTTP status, e.g. http.StatusServiceUnavailable.
+// Reconnect requests are not affected.
+func (r *Relay) FailConnects(n, status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failConnects = n
+	r.failStatus = status
+	r.failCode = 0
+}
+
+// CloseConnects makes the relay close the websocket of the next n connect requests with the given status code right
+// after the handshake, before a session is established. websocket.StatusAbnormalClosure drops the connection
+// without a close frame. Reconnect requests are not affected.
+func (r *Relay) CloseConnects(n int, code websocket.StatusCode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failConnects = n
+	r.failStatus = 0
+	r.failCode = code
+}
+
+// SetACKDelay delays every ACK sent to clients by d.
+func (r *Relay) SetACKDelay(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ackDelay = d
+}
+
+// SetBackendCloseCode makes the relay close websockets with code once the backend ends the stream, e.g.
+// iap.CloseStatusDestinationReadFailed as the IAP relay often does when an SSH session exits.
+// Zero closes them normally again.
+func (r *Relay) SetBackendCloseCode(code websocket.StatusCode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backendClose = code
+}
+
+// SendRaw sends msg as is to every connected client, e.g. to inject malformed frames.
+func (r *Relay) SendRaw(msg []byte) {
+	for _, s := range r.activeSessions() {
+		s.send(msg)
+	}
+}
+
+func (r *Relay) activeSessions() []*session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (r *Relay) getRejectCode() websocket.StatusCode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rejectCode
+}
+
+// takeConnectFailure returns how the current connect request fails, if it does.
+func (r *Relay) takeConnectFailure() (int, websocket.StatusCode, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failConnects == 0 {
+		return 0, 0, false
+	}
+
+	r.failConnects--
+	return r.failStatus, r.failCode, true
+}
+
+// closeBackendDone closes ws once the backend has ended the stream.
+func (r *Relay) closeBackendDone(ws *websocket.Conn) {
+	r.mu.Lock()
+	code := r.backendClose
+	r.mu.Unlock()
+	if code == 0 {
+		code = websocket.StatusNormalClosure
+	}
+	ws.Close(code, "backend closed")
+}
+
+func (r *Relay) getACKDelay() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ackDelay
+}
+
+func (r *Relay) removeSession(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+// ServeHTTP implements http.Handler for the connect and reconnect endpoints.
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case iap.ConnectPath:
+		r.connect(w, req)
+	case iap.ReconnectPath:
+		r.reconnect(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// accept validates the request and upgrades it to a websocket.
+func (r *Relay) accept(w http.ResponseWriter, req *http.Request) (*websocket.Conn, bool) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	r.mu.Lock()
+	r.lastToken = token
+	expired := r.tokens[token]
+	if !expired {
+		r.tokens[token] = false
+	}
+	r.mu.Unlock()
+
+	ws, err := websocket.Accept(w, req, &websocket.AcceptOptions{
+		Subprotocols:       []string{iap.RelayProtocolName},
+		InsecureSkipVerify: true, // the IAP origin is not a URL
+	})
+	if err != nil {
+		return nil, false
+	}
+
+	if ws.Subprotocol() != iap.RelayProtocolName {
+		ws.Close(websocket.StatusPolicyViolation, "unsupported subprotocol")
+		return nil, false
+	}
+
+	if code := r.getRejectCode(); code != 0 {
+		ws.Close(code, "rejected by test relay")
+		return nil, false
+	}
+
+	if expired {
+		ws.Close(iap.CloseStatusReauthenticationRequired, "access token expired")
+		return nil, false
+	}
+
+	return ws, true
+}
+
+func (r *Relay) connect(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.lastQuery = req.URL.Query()
+	r.mu.Unlock()
+	r.attempts.Add(1)
+
+	status, code, fail := r.takeConnectFailure()
+	if fail && status != 0 {
+		http.Error(w, "failed by test relay", status)
+		return
+	}
+
+	ws, ok := r.accept(w, req)
+	if !ok {
+		return
+	}
+
+	if fail {
+		if code == websocket.StatusAbnormalClosure {
+			ws.CloseNow()
+		} else {
+			ws.Close(code, "failed by test relay")
+		}
+		return
+	}
+
+	backend, err := net.Dial("tcp", r.backend)
+	if err != nil {
+		ws.Close(iap.CloseStatusFailedToConnectToBackend, err.Error())
+		return
+	}
+
+	s := &session{id: newSID(), relay: r, backend: backend}
+	r.mu.Lock()
+	r.sessions[s.id] = s
+	r.mu.Unlock()
+	r.connects.Add(1)
+
+	s.sendMu.Lock()
+	s.setWS(ws)
+	err = ws.Write(r.ctx, websocket.MessageBinary, sidFrame(s.id))
+	s.sendMu.Unlock()
+	if err != nil {
+		s.close(websocket.StatusInternalError, err.Error())
+		return
+	}
+
+	go s.pumpBackend()
+	s.serve(ws)
+}
+
+func (r *Relay) reconnect(w http.ResponseWriter, req *http.Request) {
+	ws, ok := r.accept(w, req)
+	if !ok {
+		return
+	}
+
+	query := req.URL.Query()
+	ack, err := strconv.ParseUint(query.Get("ack"), 10, 64)
+	if err != nil {
+		ws.Close(iap.CloseStatusInvalidACK, "invalid ack")
+		return
+	}
+
+	r.mu.Lock()
+	s := r.sessions[query.Get("sid")]
+	r.mu.Unlock()
+	if s == nil {
+		ws.Close(iap.CloseStatusSIDUnknown, "unknown sid")
+		return
+	}
+
+	if err := s.resume(ws, ack); err != nil {
+		ws.Close(iap.CloseStatusFailedToRewind, err.Error())
+		return
+	}
+
+	r.reconnects.Add(1)
+	s.serve(ws)
+}
+
+// session is a relay session which outlives the websockets it is served over.
+type session struct {
+	id      string
+	relay   *Relay
+	backend net.Conn
+
+	wsMu sync.Mutex
+	ws   *websocket.Conn
+
+	// sendMu serializes websocket writes and guards the outbound state
+	sendMu      sync.Mutex
+	replay      []byte // bytes sent to the client which are not acknowledged yet
+	sent        uint64
+	confirmed   uint64
+	received    uint64 // bytes received from the client
+	ackSent     uint64
+	backendDone bool
+}
+
+func (s *session) getWS() *websocket.Conn {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	return s.ws
+}
+
+func (s *session) setWS(ws *websocket.Conn) {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	s.ws = ws
+}
+
+// detach forgets ws if it is still the current websocket of the session.
+func (s *session) detach(ws *websocket.Conn) {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	if s.ws == ws {
+		s.ws = nil
+	}
+}
+
+// send writes a message to the current websocket, if any.
+func (s *session) send(msg []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.sendLocked(msg)
+}
+
+// sendLocked writes a message to the current websocket. Must be called with sendMu held.
+func (s *session) sendLocked(msg []byte) error {
+	ws := s.getWS()
+	if ws == nil {
+		return net.ErrClosed
+	}
+	return ws.Write(s.relay.ctx, websocket.MessageBinary, msg)
+}
+
+// resume attaches a new websocket to the session and resends the data the client has not received yet.
+func (s *session) resume(ws *websocket.Conn, ack uint64) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if ack < s.confirmed || ack > s.sent {
+		return fmt.Errorf("ack %d is out of range [%d, %d]", ack, s.confirmed, s.sent)
+	}
+
+	s.replay = s.replay[ack-s.confirmed:]
+	s.confirmed = ack
+
+	if prev := s.getWS(); prev != nil {
+		prev.CloseNow()
+	}
+	s.setWS(ws)
+
+	s.ackSent = s.received
+	if err := s.sendLocked(ackFrame(iap.RelayReconnectSuccessACK, s.received)); err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(s.replay); offset += iap.MaxMessageSize {
+		end := min(offset+iap.MaxMessageSize, len(s.replay))
+		if err := s.sendLocked(dataFrame(s.replay[offset:end])); err != nil {
+			return err
+		}
+	}
+
+	if s.backendDone {
+		s.relay.closeBackendDone(ws)
+	}
+	return nil
+}
+
+// serve reads frames from the client until the websocket is closed.
+func (s *session) serve(ws *websocket.Conn) {
+	defer s.detach(ws)
+	var decoder iap.FrameDecoder
+	for {
+		_, msg, err := ws.Read(s.relay.ctx)
+		if err != nil {
+			if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+				s.close(websocket.StatusNormalClosure, "")
+			}
+			return // keep the session for reconnect
+		}
+
+		frames, err := decoder.Decode(msg)
+		for _, frame := range frames {
+			switch f := frame.(type) {
+			case *iap.RelayDataFrame:
+				if _, err := s.backend.Write(f.Data); err != nil {
+					s.close(iap.CloseStatusDestinationWriteFailed, err.Error())
+					return
+				}
+				s.ack(uint64(len(f.Data)))
+			case *iap.RelayACKFrame:
+				if err := s.confirm(f.ACK); err != nil {
+					ws.Close(iap.CloseStatusInvalidACK, err.Error())
+					return
+				}
+			default:
+				ws.Close(iap.CloseStatusInvalidTag, fmt.Sprintf("unexpected tag %d", frame.Tag()))
+				return
+			}
+		}
+
+		if err != nil {
+			ws.Close(iap.CloseStatusInvalidData, "malformed frame")
+			return
+		}
+	}
+}
+
+// ack records received bytes and acknowledges them, after the configured delay.
+func (s *session) ack(n uint64) {
+	s.sendMu.Lock()
+	s.received += n
+	s.sendMu.Unlock()
+
+	delay := s.relay.getACKDelay()
+	if delay == 0 {
+		s.sendACK()
+		return
+	}
+	time.AfterFunc(delay, s.sendACK)
+}
+
+// sendACK acknowledges all received bytes, unless they are already acknowledged.
+func (s *session) sendACK() {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.received == s.ackSent {
+		return
+	}
+
+	if err := s.sendLocked(ackFrame(iap.RelayACK, s.received)); err == nil {
+		s.ackSent = s.received
+	}
+}
+
+// confirm drops the bytes acknowledged by the client from the replay buffer.
+func (s *session) confirm(ack uint64) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if ack < s.confirmed || ack > s.sent {
+		return fmt.Errorf("ack %d is out of range [%d, %d]", ack, s.confirmed, s.sent)
+	}
+
+	s.replay = s.replay[ack-s.confirmed:]
+	s.confirmed = ack
+	return nil
+}
+
+// pumpBackend forwards data from the backend to the client until the backend closes the connection.
+func (s *session) pumpBackend() {
+	buf := make([]byte, iap.MaxMessageSize)
+	for {
+		n, err := s.backend.Read(buf)
+		if n > 0 {
+			s.sendMu.Lock()
+			s.replay = append(s.replay, buf[:n]...)
+			s.sent += uint64(n)
+			s.sendLocked(dataFrame(buf[:n])) // data is resent on reconnect if the websocket is gone
+			s.sendMu.Unlock()
+		}
+
+		if err != nil {
+			s.sendMu.Lock()
+			s.backendDone = true
+			s.sendMu.Unlock()
+			if ws := s.getWS(); ws != nil {
+				s.relay.closeBackendDone(ws)
+			}
+			return
+		}
+	}
+}
+
+// close ends the session, closing both the websocket and the backend connection.
+func (s *session) close(code websocket.StatusCode, reason string) {
+	s.relay.removeSession(s.id)
+	s.backend.Close()
+	if ws := s.getWS(); ws != nil {
+		ws.Close(code, reason)
+	}
+}
+
+func newSID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sidFrame(sid string) []byte {
+	frame := make([]byte, iap.SIDHeaderLen+len(sid))
+	binary.BigEndian.PutUint16(frame, iap.RelayConnectSuccessSID)
+	binary.BigEndian.PutUint32(frame[iap.MessageTagLen:], uint32(len(sid)))
+	copy(frame[iap.SIDHeaderLen:], sid)
+	return frame
+}
+
+func ackFrame(tag uint16, ack uint64) []byte {
+	frame := make([]byte, iap.ACKHeaderLen)
+	binary.BigEndian.PutUint16(frame, tag)
+	binary.BigEndian.PutUint64(frame[iap.MessageTagLen:], ack)
+	return frame
+}
+
+func dataFrame(data []byte) []byte {
+	frame := make([]byte, iap.DataMessageHeaderLen+len(data))
+	binary.BigEndian.PutUint16(frame, iap.RelayData)
+	binary.BigEndian.PutUint32(frame[iap.MessageTagLen:], uint32(len(data)))
+	copy(frame[iap.DataMessageHeaderLen:], data)
+	return frame
+}
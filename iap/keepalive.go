@@ -0,0 +1,117 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// startKeepAlive starts the ping loop and the idle timer, if they are enabled.
+func (t *IAPTunnel) startKeepAlive() {
+	t.touch()
+	if t.pingInterval > 0 {
+		go t.pingLoop()
+	}
+
+	if t.idleTimeout > 0 {
+		t.idleMu.Lock()
+		t.idleTimer = time.AfterFunc(t.idleTimeout, t.checkIdle)
+		t.idleMu.Unlock()
+	}
+}
+
+// pingLoop pings the relay every pingInterval and drops the websocket if the pong does not arrive within
+// pongTimeout, so a black-holed connection is noticed and the session is resumed over a new one.
+// Pings are control frames written by the websocket library, they do not interfere with the writer loop.
+func (t *IAPTunnel) pingLoop() {
+	ticker := time.NewTicker(t.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+		}
+
+		ws := t.getWS()
+		if ws == nil || !t.isConnected() || t.readStalled.Load() {
+			continue // reconnecting, or the read loop is waiting for Read and can not see the pong
+		}
+
+		stalls := t.readStalls.Load()
+		ctx, cancel := context.WithTimeout(context.Background(), t.pongTimeout)
+		err := ws.Ping(ctx)
+		cancel()
+		if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+			continue // a broken websocket is noticed by the read loop
+		}
+
+		if t.readStalled.Load() || t.readStalls.Load() != stalls {
+			t.logger.Debug("Ping timed out while the receive buffer was full, ignoring")
+			continue
+		}
+
+		t.logger.Warn("Relay did not answer ping, dropping websocket", "timeout", t.pongTimeout)
+		t.dropWS(ws, ErrPingTimeout)
+	}
+}
+
+// dropWS closes a websocket which is considered dead without a close handshake. The read loop fails with
+// reason and resumes the session over a new websocket.
+func (t *IAPTunnel) dropWS(ws *websocket.Conn, reason error) {
+	t.wsMu.Lock()
+	if t.ws == ws {
+		t.dropReason = reason
+	}
+	t.wsMu.Unlock()
+	ws.CloseNow()
+}
+
+// takeDropReason returns and clears the reason why ws was dropped, or nil if it was not dropped on purpose.
+func (t *IAPTunnel) takeDropReason(ws *websocket.Conn) error {
+	t.wsMu.Lock()
+	defer t.wsMu.Unlock()
+	if t.ws != ws {
+		return nil
+	}
+
+	reason := t.dropReason
+	t.dropReason = nil
+	return reason
+}
+
+// touch records traffic for the idle timeout.
+func (t *IAPTunnel) touch() {
+	if t.idleTimeout > 0 {
+		t.lastActivity.Store(time.Now().UnixNano())
+	}
+}
+
+// checkIdle closes the tunnel once no data was sent or received for idleTimeout, otherwise it re-arms the timer.
+func (t *IAPTunnel) checkIdle() {
+	if t.isClosed() {
+		return
+	}
+
+	idle := time.Since(time.Unix(0, t.lastActivity.Load()))
+	if idle < t.idleTimeout {
+		t.idleMu.Lock()
+		t.idleTimer.Reset(t.idleTimeout - idle)
+		t.idleMu.Unlock()
+		return
+	}
+
+	t.logger.Info("Closing idle tunnel", "idle", idle.Round(time.Second))
+	t.failWithStatus(ErrIdleTimeout, CloseStatusNormal)
+}
+
+// stopIdleTimer stops the idle timer, if it was started.
+func (t *IAPTunnel) stopIdleTimer() {
+	t.idleMu.Lock()
+	defer t.idleMu.Unlock()
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+	}
+}
@@ -0,0 +1,300 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicksulia/go-tcp-over-google-iap/logger"
+)
+
+// defaultListenHosts are the addresses the local listener binds to unless others are configured.
+// Only local processes can use the tunnel, and with it the IAP identity of the caller.
+var defaultListenHosts = []string{"127.0.0.1", "::1"}
+
+// isLoopbackHost reports whether host only accepts connections from the local machine.
+// Hostnames other than localhost are not resolved and count as non-loopback.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// listenAddrs validates hosts and pairs them with port. Non-loopback hosts, including the unspecified addresses
+// which bind all interfaces, are rejected unless allowNonLoopback is set.
+func listenAddrs(hosts []string, port string, allowNonLoopback bool, log logger.Logger) ([]string, error) {
+	addrs := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if !isLoopbackHost(host) {
+			if !allowNonLoopback {
+				return nil, fmt.Errorf("refusing to listen on non-loopback address %q, anyone who can reach it can use your IAP identity", host)
+			}
+			log.Warn("Listening on a non-loopback address, anyone who can reach it can use your IAP identity", "host", host)
+		}
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+	return addrs, nil
+}
+
+// listenAll binds every address. With port 0 the first listener picks a free port, which the others reuse.
+// If optional is set, addresses which can not be bound are skipped as long as one of them is bound, e.g. ::1 on
+// machines without IPv6.
+func listenAll(ctx context.Context, addrs []string, optional bool, log logger.Logger) (net.Listener, error) {
+	var lc net.ListenConfig
+	var listeners []net.Listener
+	var errs []error
+	port := ""
+	for _, addr := range addrs {
+		if port != "" {
+			host, _, _ := net.SplitHostPort(addr)
+			addr = net.JoinHostPort(host, port)
+		}
+
+		lis, err := lc.Listen(ctx, "tcp", addr)
+		if err != nil {
+			if optional {
+				log.Debug("Skipping listen address", "addr", addr, "err", err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		if _, p, _ := net.SplitHostPort(addr); p == "0" {
+			_, port, _ = net.SplitHostPort(lis.Addr().String())
+		}
+		listeners = append(listeners, lis)
+	}
+
+	if len(listeners) == 0 || (!optional && len(errs) > 0) {
+		for _, lis := range listeners {
+			lis.Close()
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+// multiListener accepts connections from several listeners, e.g. on 127.0.0.1 and ::1.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	l := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, lis := range listeners {
+		go l.acceptLoop(lis)
+	}
+	return l
+}
+
+// acceptLoop passes the connections and errors of lis on to Accept until the listener is closed.
+func (l *multiListener) acceptLoop(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		select {
+		case l.accepted <- acceptResult{conn, err}:
+		case <-l.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+// Accept waits for the next connection on any of the listeners.
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-l.accepted:
+		return res.conn, res.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes all listeners.
+func (l *multiListener) Close() error {
+	var errs []error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		for _, lis := range l.listeners {
+			errs = append(errs, lis.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first listener.
+func (l *multiListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all listeners.
+func (l *multiListener) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(l.listeners))
+	for i, lis := range l.listeners {
+		addrs[i] = lis.Addr()
+	}
+	return addrs
+}
+
+// chmodSocket sets the mode of a socket bound by listenUnix, tests replace it to inspect the socket at that point.
+var chmodSocket = os.Chmod
+
+// listenUnix listens on the Unix socket at path and sets its file mode and group, so only the owner, or members of
+// the group, can use the tunnel. A stale socket file left behind by a previous process is removed first, a socket
+// which still accepts connections is not. The socket file is removed when the listener is closed.
+//
+// The socket is bound in a private directory and only moved to path once its mode and group are set. Bound at path
+// directly, it would be connectable with the mode allowed by the umask until it is changed.
+func listenUnix(ctx context.Context, path string, mode os.FileMode, group string) (net.Listener, error) {
+	gid := -1
+	if group != "" {
+		var err error
+		if gid, err = lookupGroup(group); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	// MkdirTemp creates the directory with mode 0700, names are short to stay within the socket path limit
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".iap")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create private directory for socket %s: %w", path, err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	var lc net.ListenConfig
+	lis, err := lc.Listen(ctx, "unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	ul := lis.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false) // the socket is moved to path, which unixListener removes
+	if err := chmodSocket(tmp, mode); err != nil {
+		ul.Close()
+		return nil, fmt.Errorf("failed to set mode of socket %s: %w", path, err)
+	}
+
+	if gid >= 0 {
+		if err := os.Chown(tmp, -1, gid); err != nil {
+			ul.Close()
+			return nil, fmt.Errorf("failed to set group of socket %s: %w", path, err)
+		}
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		ul.Close()
+		return nil, fmt.Errorf("failed to move socket to %s: %w", path, err)
+	}
+	return &unixListener{UnixListener: ul, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// unixListener is a Unix socket listener which was bound under a temporary name and moved to addr.
+type unixListener struct {
+	*net.UnixListener
+	addr      *net.UnixAddr
+	closeOnce sync.Once
+}
+
+// Addr returns the address of the socket after it was moved.
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close stops listening and removes the socket file.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.closeOnce.Do(func() {
+		os.Remove(l.addr.Name)
+	})
+	return err
+}
+
+// removeStaleSocket removes the socket file at path if no process accepts connections on it anymore.
+// Files which are not sockets are never removed.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("refusing to replace %s, it is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use by another process", path)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// lookupGroup returns the ID of the group with the given name or numeric ID.
+func lookupGroup(group string) (int, error) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		var unknown user.UnknownGroupError
+		if !errors.As(err, &unknown) {
+			return 0, fmt.Errorf("failed to look up group %s: %w", group, err)
+		}
+
+		if g, err = user.LookupGroupId(group); err != nil {
+			return 0, fmt.Errorf("failed to look up group %s: %w", group, err)
+		}
+	}
+
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("group %s has no numeric ID: %w", group, err)
+	}
+	return gid, nil
+}
@@ -0,0 +1,81 @@
+package iap
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/nicksulia/go-tcp-over-google-iap/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsLoopbackHost(t *testing.T) {
+	for host, loopback := range map[string]bool{
+		"127.0.0.1":   true,
+		"127.0.0.2":   true,
+		"::1":         true,
+		"localhost":   true,
+		"":            false,
+		"0.0.0.0":     false,
+		"::":          false,
+		"192.168.1.5": false,
+		"fe80::1%en0": false,
+		"example.com": false,
+	} {
+		assert.Equal(t, loopback, isLoopbackHost(host), host)
+	}
+}
+
+func TestListenAddrsRequiresOptIn(t *testing.T) {
+	log, err := logger.NewZapLogger("error")
+	require.NoError(t, err)
+
+	addrs, err := listenAddrs([]string{"127.0.0.1", "[::1]"}, "2223", false, log)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:2223", "[::1]:2223"}, addrs)
+
+	for _, host := range []string{"", "0.0.0.0", "::", "10.0.0.1"} {
+		_, err = listenAddrs([]string{"127.0.0.1", host}, "2223", false, log)
+		assert.Error(t, err, "%q must not be bound without opt-in", host)
+	}
+
+	addrs, err = listenAddrs([]string{"::"}, "2223", true, log)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"[::]:2223"}, addrs)
+}
+
+func TestNewListenerDefaultsToLoopback(t *testing.T) {
+	log, err := logger.NewZapLogger("error")
+	require.NoError(t, err)
+
+	lis, err := newListener(context.Background(), nil, "0", false, log)
+	require.NoError(t, err)
+	defer lis.Close()
+
+	addrs := lis.addrs()
+	require.NotEmpty(t, addrs)
+	port := netip.MustParseAddrPort(addrs[0]).Port()
+	for _, addr := range addrs {
+		ap, err := netip.ParseAddrPort(addr)
+		require.NoError(t, err)
+		assert.True(t, ap.Addr().IsLoopback(), "%s is not a loopback address", addr)
+		assert.Equal(t, port, ap.Port(), "all loopback addresses share the port")
+	}
+
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		accepted, err, closed := lis.Accept()
+		require.NoError(t, err)
+		assert.False(t, closed)
+		accepted.Close()
+		conn.Close()
+	}
+
+	lis.Close()
+	_, err, closed := lis.Accept()
+	assert.NoError(t, err)
+	assert.True(t, closed)
+}
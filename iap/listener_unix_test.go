@@ -0,0 +1,100 @@
+//go:build unix
+
+package iap
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	lis, err := listenUnix(context.Background(), path, DefaultSocketMode, strconv.Itoa(os.Getgid()))
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	assert.Equal(t, uint32(os.Getgid()), info.Sys().(*syscall.Stat_t).Gid)
+
+	_, err = listenUnix(context.Background(), path, DefaultSocketMode, "")
+	assert.ErrorContains(t, err, "in use", "a socket which accepts connections is not replaced")
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	accepted, err := lis.Accept()
+	require.NoError(t, err)
+	accepted.Close()
+	conn.Close()
+
+	require.NoError(t, lis.Close())
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist, "closing the listener removes the socket")
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	lis, err := listenUnix(context.Background(), path, 0o660, "")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+}
+
+func TestListenUnixKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+
+	_, err := listenUnix(context.Background(), path, DefaultSocketMode, "")
+	assert.ErrorContains(t, err, "not a socket")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestListenUnixIgnoresUmask(t *testing.T) {
+	umask := syscall.Umask(0) // sockets are bound connectable by everyone
+	defer syscall.Umask(umask)
+
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	chmodSocket = func(name string, mode os.FileMode) error {
+		_, err := os.Stat(path)
+		assert.ErrorIs(t, err, fs.ErrNotExist, "the socket must not be reachable at its path before its mode is set")
+
+		dir, err := os.Stat(filepath.Dir(name))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o700), dir.Mode().Perm(), "only the owner can reach the socket before its mode is set")
+		return os.Chmod(name, mode)
+	}
+	defer func() { chmodSocket = os.Chmod }()
+
+	lis, err := listenUnix(context.Background(), path, DefaultSocketMode, "")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(DefaultSocketMode), info.Mode().Perm())
+	assert.Equal(t, path, lis.Addr().String())
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "the private directory is removed")
+}
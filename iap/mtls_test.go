@@ -0,0 +1,78 @@
+package iap_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicksulia/go-tcp-over-google-iap/iap"
+	"github.com/nicksulia/go-tcp-over-google-iap/iap/iaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCertificate generates a self-signed client certificate and writes it as a PEM bundle.
+func writeClientCertificate(t *testing.T) (string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	path := filepath.Join(t.TempDir(), "client.pem")
+	require.NoError(t, os.WriteFile(path, bundle, 0o600))
+	return path, cert
+}
+
+func TestTunnelMTLSRelay(t *testing.T) {
+	bundle, clientCert := writeClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	relay := iaptest.NewMTLSRelay(startEchoBackend(t), clientCAs)
+	t.Cleanup(relay.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(relay.Certificate())
+
+	tunnel := newTestTunnel(t, relay)
+	require.NoError(t, tunnel.SetRelayConfig(iap.RelayConfig{
+		Endpoint:  relay.URL,
+		TLSConfig: &tls.Config{RootCAs: roots},
+	}))
+	assert.Error(t, tunnel.DryRun(context.Background()), "relay must reject clients without a certificate")
+
+	cert, err := iap.LoadClientCertificate(bundle, "")
+	require.NoError(t, err)
+	tunnel = newTestTunnel(t, relay)
+	require.NoError(t, tunnel.SetRelayConfig(iap.RelayConfig{
+		Endpoint:          relay.URL,
+		TLSConfig:         &tls.Config{RootCAs: roots},
+		ClientCertificate: cert,
+	}))
+	assert.NoError(t, tunnel.DryRun(context.Background()))
+}
@@ -0,0 +1,191 @@
+package iap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrProxy is returned when the relay can not be reached through the configured HTTP proxy.
+var ErrProxy = errors.New("proxy error")
+
+// ProxyError is returned when the connection to the proxy or the CONNECT request fails.
+// It unwraps to ErrProxy, so proxy failures can be told apart from relay failures.
+type ProxyError struct {
+	Proxy      string // proxy address, never includes credentials
+	StatusCode int    // status of the CONNECT response, 0 if the proxy did not respond
+	Err        error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %v", e.Proxy, e.Err)
+}
+
+// Unwrap returns ErrProxy together with the underlying error.
+func (e *ProxyError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{ErrProxy}
+	}
+	return []error{ErrProxy, e.Err}
+}
+
+// proxyDialer opens TCP connections to the relay, tunneling them through an HTTP CONNECT proxy when one is configured.
+type proxyDialer struct {
+	proxy     func(*http.Request) (*url.URL, error)
+	scheme    string      // scheme of the relay endpoint, used to select the proxy from the environment
+	tlsConfig *tls.Config // used for HTTPS proxies
+	dialer    *net.Dialer
+}
+
+// newProxyDialer returns a dialer using the explicit proxy URL, or the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// environment variables if it is empty.
+func newProxyDialer(proxy string, tlsConfig *tls.Config, endpoint *url.URL, dialer *net.Dialer) (*proxyDialer, error) {
+	d := &proxyDialer{
+		proxy:     http.ProxyFromEnvironment,
+		scheme:    "https",
+		tlsConfig: tlsConfig,
+		dialer:    dialer,
+	}
+
+	if endpoint.Scheme == "ws" {
+		d.scheme = "http"
+	}
+
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err // url.Error quotes the URL, which may contain credentials
+			}
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid proxy %q: scheme must be http or https", u.Redacted())
+		}
+
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q: host is empty", u.Redacted())
+		}
+		d.proxy = http.ProxyURL(u)
+	}
+
+	return d, nil
+}
+
+// DialContext connects to addr, through the proxy if one applies to the relay.
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyURL, err := d.proxy(&http.Request{URL: &url.URL{Scheme: d.scheme, Host: addr}})
+	if err != nil {
+		return nil, &ProxyError{Proxy: "from environment", Err: err}
+	}
+
+	if proxyURL == nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	proxyAddr := canonicalProxyAddr(proxyURL)
+	conn, err := d.dialer.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, &ProxyError{Proxy: proxyAddr, Err: err}
+	}
+
+	conn, err = d.connect(ctx, conn, proxyURL, proxyAddr, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// connect performs the TLS handshake with an HTTPS proxy and requests a tunnel to addr.
+func (d *proxyDialer) connect(ctx context.Context, conn net.Conn, proxyURL *url.URL, proxyAddr, addr string) (net.Conn, error) {
+	// Bound the handshake by the dial context, the deadline is cleared once the tunnel is established
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if proxyURL.Scheme == "https" {
+		cfg := &tls.Config{}
+		if d.tlsConfig != nil {
+			cfg = d.tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = proxyURL.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, &ProxyError{Proxy: proxyAddr, Err: err}
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, &ProxyError{Proxy: proxyAddr, Err: err}
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, &ProxyError{Proxy: proxyAddr, Err: err}
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &ProxyError{Proxy: proxyAddr, StatusCode: res.StatusCode, Err: fmt.Errorf("CONNECT %s failed with HTTP %s", addr, res.Status)}
+	}
+
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn which first returns data already read from the proxy response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// canonicalProxyAddr returns host:port of the proxy, adding the default port of its scheme.
+func canonicalProxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
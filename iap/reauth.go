@@ -0,0 +1,155 @@
+package iap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// accessToken returns the token to authenticate the next websocket with. The cached token is reused until it
+// expires or the relay rejects it, then a new one is fetched from the token source.
+func (t *IAPTunnel) accessToken() (*oauth2.Token, error) {
+	t.tokenMu.Lock()
+	defer t.tokenMu.Unlock()
+	if t.token.Valid() {
+		return t.token, nil
+	}
+
+	token, err := t.tokenSource.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil {
+		return nil, errors.New("token source returned no token")
+	}
+
+	if token.AccessToken == t.rejectedToken {
+		return nil, &tokenRejectedError{expiry: token.Expiry}
+	}
+
+	t.rejectedToken = ""
+	t.setTokenLocked(token)
+	return token, nil
+}
+
+// invalidateToken drops the cached token after the relay asked for reauthentication, so the next websocket is
+// authenticated with a fresh one. Token sources such as oauth2.ReuseTokenSource, which google.Credentials use,
+// keep returning the same token until it expires, see tokenRejectedError.
+func (t *IAPTunnel) invalidateToken() {
+	t.tokenMu.Lock()
+	defer t.tokenMu.Unlock()
+	if t.token != nil {
+		t.rejectedToken = t.token.AccessToken
+	}
+	t.token = nil
+}
+
+// tokenRejectedError is returned by accessToken when the token source returns the token the relay rejected again,
+// e.g. because the clocks are skewed or the token was revoked. Caching sources only issue a new token once the
+// rejected one expires.
+type tokenRejectedError struct {
+	expiry time.Time
+}
+
+func (e *tokenRejectedError) Error() string {
+	if e.expiry.IsZero() {
+		return "token source returned the access token rejected by the relay again"
+	}
+	return fmt.Sprintf("token source returned the access token rejected by the relay again, it expires at %s", e.expiry.Format(time.RFC3339))
+}
+
+func (e *tokenRejectedError) Unwrap() error {
+	return ErrReauthRequired
+}
+
+// wait returns how long to wait before asking the token source for a new token again, or 0 if it will not issue
+// one any time soon, e.g. the token never expires, was revoked long before its expiry or has already expired.
+func (e *tokenRejectedError) wait() time.Duration {
+	if e.expiry.IsZero() {
+		return 0
+	}
+
+	wait := time.Until(e.expiry)
+	if wait <= 0 || wait > maxRejectedWait {
+		return 0
+	}
+	return min(wait, tokenRefreshRetry) // sources usually issue a new token a bit before the old one expires
+}
+
+// setTokenLocked caches token and schedules its refresh shortly before it expires.
+// Tokens without an expiry are not refreshed. Must be called with tokenMu held.
+func (t *IAPTunnel) setTokenLocked(token *oauth2.Token) {
+	t.token = token
+	if token.Expiry.IsZero() || t.isClosed() {
+		return
+	}
+
+	lifetime := time.Until(token.Expiry)
+	t.scheduleTokenRefreshLocked(lifetime - min(tokenRefreshMargin, lifetime/2))
+}
+
+// scheduleTokenRefreshLocked runs refreshToken after d. Must be called with tokenMu held.
+func (t *IAPTunnel) scheduleTokenRefreshLocked(d time.Duration) {
+	if t.refreshTimer == nil {
+		t.refreshTimer = time.AfterFunc(d, t.refreshToken)
+		return
+	}
+	t.refreshTimer.Reset(d)
+}
+
+// refreshToken fetches a fresh token before the cached one expires and resumes the session over a websocket
+// authenticated with it, so the relay does not close the session with CloseStatusReauthenticationRequired.
+func (t *IAPTunnel) refreshToken() {
+	if t.isClosed() {
+		return
+	}
+
+	t.tokenMu.Lock()
+	current := t.token
+	if current == nil {
+		t.tokenMu.Unlock()
+		return // invalidated, the next websocket fetches a new token anyway
+	}
+
+	token, err := t.tokenSource.Token()
+	if err == nil && token == nil {
+		err = errors.New("token source returned no token")
+	}
+
+	if err != nil || token.AccessToken == current.AccessToken {
+		// Token sources usually cache tokens until they are about to expire, so ask again a bit later
+		retry := min(tokenRefreshRetry, time.Until(current.Expiry)/2)
+		if retry > 0 {
+			t.scheduleTokenRefreshLocked(retry)
+		}
+		t.tokenMu.Unlock()
+
+		if err != nil {
+			t.logger.Warn("Failed to refresh access token", "err", err)
+		}
+		return
+	}
+
+	t.setTokenLocked(token)
+	t.tokenMu.Unlock()
+
+	ws := t.getWS()
+	if ws == nil || !t.isConnected() {
+		return // reconnecting, the new websocket uses the fresh token
+	}
+
+	t.logger.Info("Access token expires soon, reauthenticating", "expiry", current.Expiry)
+	t.dropWS(ws, fmt.Errorf("%w: access token expires soon", ErrReauthRequired))
+}
+
+// stopTokenRefresh stops the token refresh timer, if it was started.
+func (t *IAPTunnel) stopTokenRefresh() {
+	t.tokenMu.Lock()
+	defer t.tokenMu.Unlock()
+	if t.refreshTimer != nil {
+		t.refreshTimer.Stop()
+	}
+}
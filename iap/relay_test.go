@@ -0,0 +1,967 @@
+package iap_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/nicksulia/go-tcp-over-google-iap/iap"
+	"github.com/nicksulia/go-tcp-over-google-iap/iap/iaptest"
+	"github.com/nicksulia/go-tcp-over-google-iap/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+var testHost = iap.IAPHost{
+	ProjectID: "test-project",
+	Zone:      "us-central1-a",
+	Instance:  "test-instance",
+	Interface: "nic0",
+	Port:      "22",
+}
+
+// startEchoBackend starts a TCP server which echoes everything back.
+func startEchoBackend(t testing.TB) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return lis.Addr().String()
+}
+
+// startRelay starts a fake relay in front of an echo backend.
+func startRelay(t testing.TB) *iaptest.Relay {
+	relay := iaptest.NewRelay(startEchoBackend(t))
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+// fastRetries retries connecting without noticeable delays.
+var fastRetries = iap.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+// newTestTunnel creates a tunnel pointing at the relay. Failures to connect are retried without noticeable delays.
+func newTestTunnel(t testing.TB, relay *iaptest.Relay) *iap.IAPTunnel {
+	log, err := logger.NewZapLogger("error")
+	require.NoError(t, err)
+
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"})
+	tunnel := iap.NewIAPTunnel(testHost, tokenSource, log)
+	require.NoError(t, tunnel.SetRelayEndpoint(relay.URL))
+	require.NoError(t, tunnel.SetRetryPolicy(fastRetries))
+	t.Cleanup(func() { tunnel.Close() })
+	return tunnel
+}
+
+// startTestTunnel starts a tunnel and waits until it is ready.
+func startTestTunnel(t testing.TB, relay *iaptest.Relay) *iap.IAPTunnel {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	tunnel := newTestTunnel(t, relay)
+	tunnel.Start(ctx)
+	select {
+	case <-tunnel.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel is not ready")
+	}
+	return tunnel
+}
+
+func TestTunnelEcho(t *testing.T) {
+	tunnel := startTestTunnel(t, startRelay(t))
+
+	payload := make([]byte, 3*iap.MaxMessageSize+100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	go tunnel.Write(payload)
+	received := make([]byte, len(payload))
+	_, err := io.ReadFull(tunnel, received)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, received)
+}
+
+func TestTunnelResumesAfterConnectionDrop(t *testing.T) {
+	relay := startRelay(t)
+	tunnel := startTestTunnel(t, relay)
+
+	_, err := tunnel.Write([]byte("before "))
+	require.NoError(t, err)
+	received := make([]byte, len("before "))
+	_, err = io.ReadFull(tunnel, received)
+	require.NoError(t, err)
+
+	relay.DropConnections()
+
+	_, err = tunnel.Write([]byte("after drop"))
+	require.NoError(t, err)
+	received = make([]byte, len("after drop"))
+	_, err = io.ReadFull(tunnel, received)
+	require.NoError(t, err)
+	assert.Equal(t, "after drop", string(received))
+	assert.Equal(t, 1, relay.Connects())
+	assert.Equal(t, 1, relay.Reconnects())
+}
+
+func TestTunnelRemoteAddrDuringReconnect(t *testing.T) {
+	relay := startRelay(t)
+	tunnel := startTestTunnel(t, relay)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_ = tunnel.RemoteAddr().String()
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		relay.DropConnections()
+		_, err := tunnel.Write([]byte("ping"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(tunnel, make([]byte, len("ping")))
+		require.NoError(t, err)
+	}
+	close(done)
+	<-stopped
+	assert.Equal(t, 3, relay.Reconnects())
+}
+
+// startTunnelThrough starts tunnel, which reaches the relay through front, and waits until it is ready.
+// front usually passes requests on to the relay.
+func startTunnelThrough(t *testing.T, tunnel *iap.IAPTunnel, front http.HandlerFunc) {
+	server := httptest.NewServer(front)
+	t.Cleanup(server.Close)
+	require.NoError(t, tunnel.SetRelayEndpoint("ws://"+server.Listener.Addr().String()))
+	tunnel.Start(context.Background())
+	select {
+	case <-tunnel.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel is not ready")
+	}
+}
+
+func TestTunnelResumeFailsFast(t *testing.T) {
+	t.Run("session lost", func(t *testing.T) {
+		relay := startRelay(t)
+		tunnel := startTestTunnel(t, relay)
+
+		relay.CloseConnections(iap.CloseStatusSIDUnknown, "unknown sid")
+		start := time.Now()
+		waitDone(t, tunnel)
+		assert.ErrorIs(t, tunnel.Err(), iap.ErrSessionLost)
+		assert.Less(t, time.Since(start), time.Second, "a lost session is not retried")
+		assert.Zero(t, relay.Reconnects())
+	})
+
+	t.Run("not authorized", func(t *testing.T) {
+		relay := startRelay(t)
+		tunnel := newTestTunnel(t, relay)
+		startTunnelThrough(t, tunnel, func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == iap.ReconnectPath {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			relay.ServeHTTP(w, req)
+		})
+
+		relay.DropConnections()
+		start := time.Now()
+		waitDone(t, tunnel)
+		assert.ErrorIs(t, tunnel.Err(), iap.ErrNotAuthorized)
+		assert.Less(t, time.Since(start), time.Second, "a rejected reconnect is not retried")
+	})
+}
+
+func TestTunnelCloseDuringReconnect(t *testing.T) {
+	relay := startRelay(t)
+	var open atomic.Int32
+	reconnecting := make(chan struct{}, 1)
+	tunnel := newTestTunnel(t, relay)
+	startTunnelThrough(t, tunnel, func(w http.ResponseWriter, req *http.Request) {
+		open.Add(1)
+		defer open.Add(-1)
+		if req.URL.Path == iap.ReconnectPath {
+			reconnecting <- struct{}{}
+			time.Sleep(200 * time.Millisecond) // the tunnel is closed while this dial is in flight
+		}
+		relay.ServeHTTP(w, req)
+	})
+
+	relay.DropConnections()
+	<-reconnecting
+	tunnel.Close() // fails to close the dropped websocket gracefully
+
+	assert.Eventually(t, func() bool { return open.Load() == 0 }, 2*time.Second, 10*time.Millisecond,
+		"the websocket dialed while closing must not stay open")
+	assert.Equal(t, io.EOF, tunnel.Err())
+}
+
+func TestTunnelCoalescedWrites(t *testing.T) {
+	relay := startRelay(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	tunnel := newTestTunnel(t, relay)
+	require.NoError(t, tunnel.SetCoalesceDelay(2*time.Millisecond))
+	tunnel.Start(ctx)
+	<-tunnel.Ready()
+
+	payload := make([]byte, 1000*37)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	go func() {
+		for i := 0; i < len(payload); i += 37 {
+			if i == len(payload)/2 {
+				relay.DropConnections() // held back bytes are sent after the session is resumed
+			}
+			tunnel.Write(payload[i : i+37])
+		}
+	}()
+
+	received := make([]byte, len(payload))
+	_, err := io.ReadFull(tunnel, received)
+	require.NoError(t, err)
+	assert.Equal(t, payload, received)
+}
+
+func TestTunnelAsNetConn(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello over iap"))
+	}))
+	t.Cleanup(backend.Close)
+	relay := iaptest.NewRelay(backend.Listener.Addr().String())
+	t.Cleanup(relay.Close)
+
+	var conn net.Conn = startTestTunnel(t, relay)
+	assert.Equal(t, "test-project/us-central1-a/test-instance:22", conn.RemoteAddr().String())
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if assert.True(t, ok) {
+		assert.True(t, local.IP.IsLoopback())
+	}
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, conn.SetDeadline(time.Time{}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "example.com"})
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(tlsConn))
+
+	res, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello over iap", string(body))
+}
+
+// BenchmarkTunnelThroughput echoes 1 MB per iteration through the fake relay, allocations are reported per MB.
+func BenchmarkTunnelThroughput(b *testing.B) {
+	const size = 1024 * 1024
+	tunnel := startTestTunnel(b, startRelay(b))
+
+	payload := make([]byte, size)
+	buf := make([]byte, 32*1024)
+	errs := make(chan error, 1)
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		go func() {
+			_, err := tunnel.Write(payload)
+			errs <- err
+		}()
+
+		for received := 0; received < size; {
+			n, err := tunnel.Read(buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			received += n
+		}
+
+		if err := <-errs; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// startHalfCloseRelay starts a fake relay in front of a backend which replies to the first line it reads and then
+// ends the stream.
+func startHalfCloseRelay(t *testing.T) *iaptest.Relay {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				time.Sleep(20 * time.Millisecond) // reply after the client has shut down its sending side
+				conn.Write([]byte("reply to " + line))
+			}()
+		}
+	}()
+	relay := iaptest.NewRelay(backend.Addr().String())
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+// startHalfCloseClient serves a client in front of the relay of startHalfCloseRelay and returns its local address.
+func startHalfCloseClient(t *testing.T) string {
+	return startClient(t, startHalfCloseRelay(t), func(*iap.IAPTunnelClient) {})
+}
+
+// newTestClient creates a client pointing at the relay which listens on localPort.
+func newTestClient(t *testing.T, relay *iaptest.Relay, localPort string) *iap.IAPTunnelClient {
+	log, err := logger.NewZapLogger("error")
+	require.NoError(t, err)
+	client, err := iap.NewIAPTunnelClient(testHost, localPort)
+	require.NoError(t, err)
+	require.NoError(t, client.SetLogger(log))
+	require.NoError(t, client.SetCredentials(&google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"})}))
+	require.NoError(t, client.SetRelayEndpoint(relay.URL))
+	return client
+}
+
+// startClient serves a client in front of the relay and returns its local address.
+// configure is called before the client starts serving.
+func startClient(t *testing.T, relay *iaptest.Relay, configure func(*iap.IAPTunnelClient)) string {
+	client := newTestClient(t, relay, "0")
+	configure(client)
+	return serveClient(t, client).String()
+}
+
+// serveClient serves client until the test ends and returns the address it listens on.
+func serveClient(t *testing.T, client *iap.IAPTunnelClient) net.Addr {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	served := make(chan error, 1)
+	go func() { served <- client.Serve(ctx) }()
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case <-client.Ready():
+	case err := <-served:
+		t.Fatalf("Serve returned before listening: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("client is not ready")
+	}
+	return client.Addr()
+}
+
+func TestClientHalfClose(t *testing.T) {
+	addr := startHalfCloseClient(t)
+
+	t.Run("local side", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		reply, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "reply to hello\n", string(reply))
+	})
+
+	t.Run("relay side", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hello\n"))
+		require.NoError(t, err)
+
+		// The sending side stays open, EOF from the backend must still reach the client
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		reply, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "reply to hello\n", string(reply))
+	})
+}
+
+// echo writes msg to the tunnel and expects it back.
+func echo(t *testing.T, tunnel *iap.IAPTunnel, msg string) {
+	t.Helper()
+	_, err := tunnel.Write([]byte(msg))
+	require.NoError(t, err)
+	received := make([]byte, len(msg))
+	_, err = io.ReadFull(tunnel, received)
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(received))
+}
+
+func TestTunnelPingTimeout(t *testing.T) {
+	relay := startRelay(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	tunnel := newTestTunnel(t, relay)
+	require.NoError(t, tunnel.SetPingInterval(20*time.Millisecond, 50*time.Millisecond))
+	tunnel.Start(ctx)
+	<-tunnel.Ready()
+	echo(t, tunnel, "before")
+
+	relay.BlackHoleConnections()
+	require.Eventually(t, func() bool {
+		return relay.Reconnects() == 1
+	}, 5*time.Second, 10*time.Millisecond, "the dead websocket should be replaced")
+	echo(t, tunnel, "after black hole")
+}
+
+func TestTunnelHungSession(t *testing.T) {
+	relay := startRelay(t)
+	tunnel := startTestTunnel(t, relay)
+	echo(t, tunnel, "before")
+
+	relay.SendRaw(make([]byte, iap.HangedMessageLen))
+	require.Eventually(t, func() bool {
+		return relay.Reconnects() == 1
+	}, 5*time.Second, 10*time.Millisecond, "the hung websocket should be replaced")
+	echo(t, tunnel, "after hang")
+}
+
+func TestTunnelDropReasonWhenResumeFails(t *testing.T) {
+	t.Run("ping timeout", func(t *testing.T) {
+		relay := startRelay(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		tunnel := newTestTunnel(t, relay)
+		require.NoError(t, tunnel.SetPingInterval(20*time.Millisecond, 50*time.Millisecond))
+		tunnel.Start(ctx)
+		<-tunnel.Ready()
+
+		relay.RejectConnections(iap.CloseStatusSIDUnknown)
+		relay.BlackHoleConnections()
+		<-tunnel.Done()
+		assert.ErrorIs(t, tunnel.Err(), iap.ErrPingTimeout)
+		assert.ErrorIs(t, tunnel.Err(), iap.ErrSessionLost)
+	})
+
+	t.Run("hung session", func(t *testing.T) {
+		relay := startRelay(t)
+		tunnel := startTestTunnel(t, relay)
+
+		relay.RejectConnections(iap.CloseStatusSIDUnknown)
+		relay.SendRaw(make([]byte, iap.HangedMessageLen))
+		<-tunnel.Done()
+		assert.ErrorIs(t, tunnel.Err(), iap.ErrSessionHung)
+		assert.ErrorIs(t, tunnel.Err(), iap.ErrSessionLost)
+	})
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	relay := startRelay(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	tunnel := newTestTunnel(t, relay)
+	require.NoError(t, tunnel.SetIdleTimeout(100*time.Millisecond))
+	tunnel.Start(ctx)
+	<-tunnel.Ready()
+
+	for i := 0; i < 4; i++ {
+		echo(t, tunnel, "keep alive") // traffic resets the idle timeout
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err := tunnel.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, iap.ErrIdleTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// tokenCounter returns a new access token on every call, expiring after lifetime unless it is 0.
+type tokenCounter struct {
+	mu       sync.Mutex
+	issued   int
+	lifetime time.Duration
+}
+
+func (c *tokenCounter) Token() (*oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.issued++
+	token := &oauth2.Token{AccessToken: fmt.Sprintf("token-%d", c.issued)}
+	if c.lifetime > 0 {
+		token.Expiry = time.Now().Add(c.lifetime)
+	}
+	return token, nil
+}
+
+// startTokenTunnel starts a tunnel authenticated by source and waits until it is ready.
+func startTokenTunnel(t *testing.T, relay *iaptest.Relay, source oauth2.TokenSource) *iap.IAPTunnel {
+	log, err := logger.NewZapLogger("error")
+	require.NoError(t, err)
+
+	tunnel := iap.NewIAPTunnel(testHost, source, log)
+	require.NoError(t, tunnel.SetRelayEndpoint(relay.URL))
+	t.Cleanup(func() { tunnel.Close() })
+	tunnel.Start(context.Background())
+	select {
+	case <-tunnel.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel is not ready")
+	}
+	return tunnel
+}
+
+func TestTunnelReauthentication(t *testing.T) {
+	relay := startRelay(t)
+	tunnel := startTokenTunnel(t, relay, &tokenCounter{})
+	echo(t, tunnel, "before")
+	assert.Equal(t, "token-1", relay.LastToken())
+
+	relay.ExpireTokens()
+	require.Eventually(t, func() bool {
+		return relay.Reconnects() == 1
+	}, 5*time.Second, 10*time.Millisecond, "the session should be resumed with a fresh token")
+	echo(t, tunnel, "after reauthentication")
+	assert.Equal(t, "token-2", relay.LastToken())
+	assert.Equal(t, 1, relay.Connects())
+}
+
+func TestTunnelReauthenticationWithCachingTokenSource(t *testing.T) {
+	relay := startRelay(t)
+	log, err := logger.NewZapLogger("error")
+	require.NoError(t, err)
+
+	// Like google.Credentials, the source returns the cached token until it is about to expire
+	source := oauth2.ReuseTokenSourceWithExpiry(nil, &tokenCounter{lifetime: time.Second}, time.Millisecond)
+	tunnel := iap.NewIAPTunnel(testHost, source, log)
+	t.Cleanup(func() { tunnel.Close() })
+	var reconnects atomic.Int32
+	startTunnelThrough(t, tunnel, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == iap.ReconnectPath {
+			reconnects.Add(1)
+		}
+		relay.ServeHTTP(w, req)
+	})
+	echo(t, tunnel, "before")
+
+	relay.ExpireTokens() // the relay rejects the token although it is still valid locally
+	require.Eventually(t, func() bool {
+		return relay.Reconnects() == 1
+	}, 5*time.Second, 10*time.Millisecond, "the session should be resumed once the source issues a new token")
+	echo(t, tunnel, "after reauthentication")
+	assert.Equal(t, "token-2", relay.LastToken())
+	assert.EqualValues(t, 1, reconnects.Load(), "the rejected token must not be sent again")
+}
+
+func TestTunnelRefreshesTokenBeforeExpiry(t *testing.T) {
+	relay := startRelay(t)
+	// The source caches tokens until 200ms before they expire, as token sources of Google credentials do
+	source := oauth2.ReuseTokenSourceWithExpiry(nil, &tokenCounter{lifetime: time.Second}, 200*time.Millisecond)
+	tunnel := startTokenTunnel(t, relay, source)
+	started := time.Now()
+	echo(t, tunnel, "before")
+
+	require.Eventually(t, func() bool {
+		return relay.Reconnects() == 1
+	}, 5*time.Second, 10*time.Millisecond, "the session should be resumed with a fresh token")
+	assert.Less(t, time.Since(started), time.Second, "the token should be refreshed before it expires")
+	assert.Equal(t, "token-2", relay.LastToken())
+	echo(t, tunnel, "after refresh")
+}
+
+func TestTunnelDryRunRejected(t *testing.T) {
+	relay := startRelay(t)
+	relay.RejectConnections(iap.CloseStatusNotAuthorized)
+
+	err := newTestTunnel(t, relay).DryRun(context.Background())
+	assert.ErrorIs(t, err, iap.ErrNotAuthorized)
+}
+
+func TestTunnelRetriesTransientConnectFailures(t *testing.T) {
+	cases := map[string]func(*iaptest.Relay){
+		"service unavailable": func(r *iaptest.Relay) { r.FailConnects(2, http.StatusServiceUnavailable) },
+		"abnormal closure":    func(r *iaptest.Relay) { r.CloseConnects(2, websocket.StatusAbnormalClosure) },
+		"lookup failed":       func(r *iaptest.Relay) { r.CloseConnects(2, iap.CloseStatusLookupFailedReconnect) },
+	}
+
+	for name, fail := range cases {
+		t.Run(name, func(t *testing.T) {
+			relay := startRelay(t)
+			fail(relay)
+
+			tunnel := newTestTunnel(t, relay)
+			tunnel.Start(context.Background())
+			select {
+			case <-tunnel.Ready():
+			case <-time.After(5 * time.Second):
+				t.Fatal("tunnel is not ready")
+			}
+
+			echo(t, tunnel, "after retries")
+			assert.Equal(t, 3, relay.ConnectAttempts())
+		})
+	}
+}
+
+func TestTunnelConnectFailsFast(t *testing.T) {
+	relay := startRelay(t)
+	relay.RejectConnections(iap.CloseStatusNotAuthorized)
+
+	tunnel := newTestTunnel(t, relay)
+	tunnel.Start(context.Background())
+
+	_, err := tunnel.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, iap.ErrNotAuthorized)
+	assert.Equal(t, 1, relay.ConnectAttempts(), "authorization failures are not retried")
+}
+
+func TestTunnelDestinationReadFailedBeforeSession(t *testing.T) {
+	relay := startRelay(t)
+	relay.RejectConnections(iap.CloseStatusDestinationReadFailed)
+
+	tunnel := newTestTunnel(t, relay)
+	tunnel.Start(context.Background())
+
+	_, err := tunnel.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, iap.ErrBackendUnreachable, "only an established session ends with EOF")
+}
+
+func TestTunnelConnectGivesUp(t *testing.T) {
+	relay := startRelay(t)
+	relay.FailConnects(10, http.StatusBadGateway)
+
+	tunnel := newTestTunnel(t, relay)
+	tunnel.Start(context.Background())
+
+	_, err := tunnel.Read(make([]byte, 1))
+	var handshakeErr *iap.HandshakeError
+	if assert.ErrorAs(t, err, &handshakeErr) {
+		assert.Equal(t, http.StatusBadGateway, handshakeErr.StatusCode)
+	}
+	assert.Equal(t, 3, relay.ConnectAttempts())
+}
+
+func TestClientClosesConnectionWhenTunnelFails(t *testing.T) {
+	relay := startRelay(t)
+	addr := startClient(t, relay, func(c *iap.IAPTunnelClient) {
+		require.NoError(t, c.SetRetryPolicy(fastRetries))
+	})
+	relay.RejectConnections(iap.CloseStatusFailedToConnectToBackend)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "the local connection should be closed once the tunnel fails")
+}
+
+func TestClientEphemeralPort(t *testing.T) {
+	client := newTestClient(t, startRelay(t), "0")
+	assert.Nil(t, client.Addr(), "there is no address before serving")
+
+	addr, ok := serveClient(t, client).(*net.TCPAddr)
+	require.True(t, ok)
+	assert.True(t, addr.IP.IsLoopback())
+	assert.NotZero(t, addr.Port, "a free port is picked")
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	client := newTestClient(t, startRelay(t), "0")
+	path := filepath.Join(t.TempDir(), "tunnel.sock")
+	require.NoError(t, client.SetUnixSocket(path, 0, ""))
+	assert.Error(t, client.SetUnixSocket(path, os.ModeSetuid|0o600, ""))
+
+	addr := serveClient(t, client)
+	assert.Equal(t, path, addr.String())
+	conn, err := net.Dial(addr.Network(), addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(iap.DefaultSocketMode), info.Mode().Perm())
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+}
+
+func TestClientServeStdio(t *testing.T) {
+	client := newTestClient(t, startHalfCloseRelay(t), "0")
+	stdin, in := io.Pipe()
+	out, stdout := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- client.ServeStdio(context.Background(), stdin, stdout) }()
+
+	// The reply still arrives after EOF on stdin, stdout is closed once the backend ends the stream
+	_, err := in.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	reply, err := io.ReadAll(out)
+	require.NoError(t, err)
+	assert.Equal(t, "reply to hello\n", string(reply))
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err, "a normally closed session is not an error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeStdio did not return")
+	}
+}
+
+func TestClientServeStdioBackendReadFailed(t *testing.T) {
+	relay := startHalfCloseRelay(t)
+	relay.SetBackendCloseCode(iap.CloseStatusDestinationReadFailed)
+	client := newTestClient(t, relay, "0")
+	stdin, in := io.Pipe()
+	out, stdout := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- client.ServeStdio(context.Background(), stdin, stdout) }()
+
+	// The relay reports the end of an established session as a failed read, e.g. after an SSH logout
+	_, err := in.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	reply, err := io.ReadAll(out)
+	require.NoError(t, err)
+	assert.Equal(t, "reply to hello\n", string(reply))
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err, "the end of the session is not an error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeStdio did not return")
+	}
+	assert.Zero(t, relay.Reconnects(), "the ended session is not resumed")
+}
+
+func TestClientServeStdioFails(t *testing.T) {
+	relay := startRelay(t)
+	client := newTestClient(t, relay, "0")
+	require.NoError(t, client.SetRetryPolicy(fastRetries))
+	relay.RejectConnections(iap.CloseStatusFailedToConnectToBackend)
+
+	// stdin is never closed, like a ProxyCommand whose ssh is still waiting for the server
+	stdin, _ := io.Pipe()
+	out, stdout := io.Pipe()
+	err := client.ServeStdio(context.Background(), stdin, stdout)
+	var closeErr *iap.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.EqualValues(t, iap.CloseStatusFailedToConnectToBackend, closeErr.Code)
+
+	_, err = out.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "stdout is closed once the tunnel fails")
+}
+
+// waitDone waits until the tunnel has ended.
+func waitDone(t *testing.T, tunnel *iap.IAPTunnel) {
+	t.Helper()
+	select {
+	case <-tunnel.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not end")
+	}
+}
+
+func TestTunnelDoneAndErr(t *testing.T) {
+	t.Run("closed", func(t *testing.T) {
+		tunnel := startTestTunnel(t, startRelay(t))
+		assert.NoError(t, tunnel.Err(), "no error while the tunnel is open")
+
+		tunnel.Close()
+		waitDone(t, tunnel)
+		assert.Equal(t, io.EOF, tunnel.Err())
+	})
+
+	t.Run("backend unreachable", func(t *testing.T) {
+		relay := startRelay(t)
+		relay.RejectConnections(iap.CloseStatusFailedToConnectToBackend)
+		tunnel := newTestTunnel(t, relay)
+		tunnel.Start(context.Background())
+
+		waitDone(t, tunnel)
+		var closeErr *iap.CloseError
+		if assert.ErrorAs(t, tunnel.Err(), &closeErr) {
+			assert.EqualValues(t, iap.CloseStatusFailedToConnectToBackend, closeErr.Code)
+		}
+		assert.ErrorIs(t, tunnel.Err(), iap.ErrBackendUnreachable)
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		tunnel := newTestTunnel(t, startRelay(t))
+		tunnel.Start(ctx)
+		<-tunnel.Ready()
+
+		cancel()
+		waitDone(t, tunnel)
+		assert.ErrorIs(t, tunnel.Err(), context.Canceled)
+	})
+}
+
+func TestTunnelMalformedFrame(t *testing.T) {
+	relay := startRelay(t)
+	tunnel := startTestTunnel(t, relay)
+
+	relay.SendRaw([]byte{0x00, 0x04, 0xff, 0xff, 0xff, 0xff}) // data frame exceeding MaxMessageSize
+
+	_, err := tunnel.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, iap.ErrProtocol)
+}
+
+func TestTunnelTLSRelayWithCustomRootCA(t *testing.T) {
+	relay := iaptest.NewTLSRelay(startEchoBackend(t))
+	t.Cleanup(relay.Close)
+
+	tunnel := newTestTunnel(t, relay)
+	assert.Error(t, tunnel.DryRun(context.Background()), "self-signed relay certificate must not be trusted by default")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(relay.Certificate())
+	tunnel = newTestTunnel(t, relay)
+	require.NoError(t, tunnel.SetRelayConfig(iap.RelayConfig{
+		Endpoint:  relay.URL,
+		TLSConfig: &tls.Config{RootCAs: roots},
+	}))
+	assert.NoError(t, tunnel.DryRun(context.Background()))
+}
+
+// TestTunnelConcurrentStress exercises concurrent writers, readers, ACKs and reconnects, it is meant to run with -race.
+func TestTunnelConcurrentStress(t *testing.T) {
+	relay := startRelay(t)
+	relay.SetACKDelay(time.Millisecond)
+
+	const tunnels = 4
+	const size = 512 * 1024
+
+	var wg sync.WaitGroup
+	for i := 0; i < tunnels; i++ {
+		tunnel := startTestTunnel(t, relay)
+		payload := make([]byte, size)
+		for j := range payload {
+			payload[j] = byte(i + j*7)
+		}
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for offset := 0; offset < size; {
+				n := min(1+offset%(3*iap.MaxMessageSize), size-offset)
+				if _, err := tunnel.Write(payload[offset : offset+n]); err != nil {
+					t.Errorf("write failed: %v", err)
+					return
+				}
+				offset += n
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			received := make([]byte, size)
+			if _, err := io.ReadFull(tunnel, received); err != nil {
+				t.Errorf("read failed: %v", err)
+				return
+			}
+			assert.Equal(t, payload, received)
+		}()
+	}
+
+	dropped := make(chan struct{})
+	go func() {
+		defer close(dropped)
+		for i := 0; i < 3; i++ {
+			time.Sleep(20 * time.Millisecond)
+			relay.DropConnections()
+		}
+	}()
+
+	wg.Wait()
+	<-dropped
+}
+
+func TestTunnelSlowReader(t *testing.T) {
+	relay := startRelay(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	tunnel := newTestTunnel(t, relay)
+	require.NoError(t, tunnel.SetReceiveBuffer(iap.MinReceiveBuffer))
+	tunnel.Start(ctx)
+	<-tunnel.Ready()
+
+	payload := make([]byte, 16*iap.MinReceiveBuffer)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	go tunnel.Write(payload)
+
+	received := make([]byte, 0, len(payload))
+	buf := make([]byte, 4096)
+	for len(received) < len(payload) {
+		n, err := tunnel.Read(buf)
+		require.NoError(t, err)
+		received = append(received, buf[:n]...)
+		if len(received)%(64*1024) < 4096 {
+			time.Sleep(time.Millisecond) // let the buffer fill up
+		}
+	}
+	assert.Equal(t, payload, received)
+}
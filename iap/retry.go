@@ -0,0 +1,156 @@
+package iap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// RetryPolicy controls how establishing a new session is retried. Only transient failures are retried, such as
+// 5xx responses, dropped connections and CloseStatusLookupFailedReconnect. Authorization and lookup failures are
+// returned right away. Zero fields select the defaults, see DefaultRetryPolicy.
+type RetryPolicy struct {
+	MaxAttempts    int           // attempts including the first one, 1 disables retries
+	InitialBackoff time.Duration // wait before the first retry, it doubles with every attempt
+	MaxBackoff     time.Duration // upper bound of the wait between attempts
+	Jitter         float64       // fraction of the wait which is randomized to spread out retries, negative disables it
+	Timeout        time.Duration // overall deadline for connecting including retries, negative disables it
+}
+
+// DefaultRetryPolicy returns the policy used unless another one is configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    DefaultConnectAttempts,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+		Jitter:         DefaultBackoffJitter,
+		Timeout:        DefaultConnectTimeout,
+	}
+}
+
+// withDefaults replaces zero fields with their defaults and validates the policy.
+func (p RetryPolicy) withDefaults() (RetryPolicy, error) {
+	def := DefaultRetryPolicy()
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = def.MaxAttempts
+	}
+
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = def.InitialBackoff
+	}
+
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = max(def.MaxBackoff, p.InitialBackoff)
+	}
+
+	if p.Jitter == 0 {
+		p.Jitter = def.Jitter
+	}
+
+	if p.Timeout == 0 {
+		p.Timeout = def.Timeout
+	}
+
+	if p.MaxAttempts < 0 {
+		return p, fmt.Errorf("max attempts must not be negative, got %d", p.MaxAttempts)
+	}
+
+	if p.InitialBackoff < 0 || p.MaxBackoff < p.InitialBackoff {
+		return p, fmt.Errorf("backoff must be positive and at most max backoff, got %s and %s", p.InitialBackoff, p.MaxBackoff)
+	}
+
+	if p.Jitter > 1 {
+		return p, fmt.Errorf("jitter must be at most 1, got %g", p.Jitter)
+	}
+
+	return p, nil
+}
+
+// backoff returns the wait after the given number of failed attempts.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxBackoff)
+
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// deadline returns when connecting started at start must give up, or the zero time if there is no limit.
+func (p RetryPolicy) deadline(start time.Time) time.Time {
+	if p.Timeout < 0 {
+		return time.Time{}
+	}
+	return start.Add(p.Timeout)
+}
+
+// isRetryable reports whether connecting failed for a transient reason and may succeed when retried.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, net.ErrClosed) {
+		return false
+	}
+
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code == CloseStatusLookupFailedReconnect
+	}
+
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		return isRetryableStatus(handshakeErr.StatusCode)
+	}
+
+	var proxyErr *ProxyError
+	if errors.As(err, &proxyErr) && proxyErr.StatusCode != 0 {
+		return isRetryableStatus(proxyErr.StatusCode)
+	}
+
+	var wsCloseErr websocket.CloseError
+	if errors.As(err, &wsCloseErr) {
+		switch wsCloseErr.Code {
+		case websocket.StatusAbnormalClosure, websocket.StatusGoingAway, websocket.StatusInternalError,
+			websocket.StatusServiceRestart, websocket.StatusTryAgainLater:
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, ErrPingTimeout) || errors.Is(err, ErrSessionHung) {
+		return true
+	}
+
+	// The relay or the client rejected the certificates
+	var certErr *tls.CertificateVerificationError
+	var alert tls.AlertError
+	if errors.As(err, &certErr) || errors.As(err, &alert) {
+		return false
+	}
+
+	// url.Error implements net.Error itself, only the error it wraps tells whether the failure is transient
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	// Dropped connections and network errors such as refused connections or timeouts
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// isRetryableStatus reports whether an HTTP status returned by the relay or the proxy is transient.
+func isRetryableStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
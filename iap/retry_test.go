@@ -0,0 +1,89 @@
+package iap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryable(t *testing.T) {
+	dialErr := errors.New("expected handshake response status code 101")
+	cases := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"service unavailable", relayError(dialErr, &http.Response{StatusCode: http.StatusServiceUnavailable}), true},
+		{"too many requests", relayError(dialErr, &http.Response{StatusCode: http.StatusTooManyRequests}), true},
+		{"forbidden", relayError(dialErr, &http.Response{StatusCode: http.StatusForbidden}), false},
+		{"not found", relayError(dialErr, &http.Response{StatusCode: http.StatusNotFound}), false},
+		{"lookup failed on reconnect", &CloseError{Code: CloseStatusLookupFailedReconnect}, true},
+		{"lookup failed", &CloseError{Code: CloseStatusLookupFailed}, false},
+		{"not authorized", &CloseError{Code: CloseStatusNotAuthorized}, false},
+		{"backend unreachable", &CloseError{Code: CloseStatusFailedToConnectToBackend}, false},
+		{"abnormal closure", fmt.Errorf("read: %w", websocket.CloseError{Code: websocket.StatusAbnormalClosure}), true},
+		{"policy violation", websocket.CloseError{Code: websocket.StatusPolicyViolation}, false},
+		{"dropped connection", fmt.Errorf("failed to read frame header: %w", io.EOF), true},
+		{"connection refused", &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{"certificate", &url.Error{Op: "Get", Err: &tls.CertificateVerificationError{Err: errors.New("unknown authority")}}, false},
+		{"client certificate", &url.Error{Op: "Get", Err: &net.OpError{Op: "remote error", Err: tls.AlertError(116)}}, false},
+		{"proxy auth", &ProxyError{StatusCode: http.StatusProxyAuthRequired}, false},
+		{"proxy gateway", &ProxyError{StatusCode: http.StatusBadGateway}, true},
+		{"invalid proxy", &url.Error{Op: "Get", Err: &ProxyError{Err: errors.New("invalid proxy URL")}}, false},
+		{"cancelled", fmt.Errorf("dial: %w", context.Canceled), false},
+		{"ping timeout", ErrPingTimeout, true},
+		{"token", errors.New("oauth2: invalid_grant"), false},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.retryable, isRetryable(tc.err), tc.name)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: -1}
+	policy, err := policy.withDefaults()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(2))
+	assert.Equal(t, 800*time.Millisecond, policy.backoff(4))
+	assert.Equal(t, time.Second, policy.backoff(10), "backoff is capped")
+
+	policy.Jitter = 0.5
+	for range 100 {
+		d := policy.backoff(1)
+		assert.GreaterOrEqual(t, d, 50*time.Millisecond)
+		assert.LessOrEqual(t, d, 150*time.Millisecond)
+	}
+}
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	policy, err := RetryPolicy{}.withDefaults()
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultRetryPolicy(), policy)
+	assert.False(t, policy.deadline(time.Now()).IsZero())
+
+	policy, err = RetryPolicy{MaxAttempts: 1, Timeout: -1}.withDefaults()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, policy.MaxAttempts)
+	assert.True(t, policy.deadline(time.Now()).IsZero(), "a negative timeout disables the deadline")
+
+	_, err = RetryPolicy{MaxAttempts: -1}.withDefaults()
+	assert.Error(t, err)
+	_, err = RetryPolicy{InitialBackoff: time.Minute, MaxBackoff: time.Second}.withDefaults()
+	assert.Error(t, err)
+	_, err = RetryPolicy{Jitter: 2}.withDefaults()
+	assert.Error(t, err)
+}
@@ -0,0 +1,48 @@
+package iap
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// stdioConn joins a reader and a writer, e.g. stdin and stdout, into a connection which can be half-closed.
+// The reader is drained in the background, so Close does not wait for input which may never arrive.
+type stdioConn struct {
+	r   *io.PipeReader
+	out io.WriteCloser
+}
+
+func newStdioConn(in io.Reader, out io.WriteCloser) *stdioConn {
+	r, w := io.Pipe()
+	go func() {
+		_, err := io.Copy(w, in)
+		w.CloseWithError(err) // EOF once in is done
+	}()
+	return &stdioConn{r: r, out: out}
+}
+
+// Read reads from the input.
+func (c *stdioConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write writes to the output.
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+// CloseWrite closes the output to signal EOF while the input is still read.
+func (c *stdioConn) CloseWrite() error {
+	return c.out.Close()
+}
+
+// Close stops reading the input and closes the output.
+func (c *stdioConn) Close() error {
+	c.r.Close()
+	// The output may already be closed by CloseWrite
+	if err := c.out.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
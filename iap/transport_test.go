@@ -0,0 +1,79 @@
+package iap
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRelayDialerDefaults(t *testing.T) {
+	d, err := newRelayDialer(RelayConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, "wss://tunnel.cloudproxy.app", d.endpoint.String())
+	assert.Equal(t, DefaultHandshakeTimeout, d.handshakeTimeout)
+	assert.NotNil(t, d.client)
+}
+
+func TestNewRelayDialerEndpoint(t *testing.T) {
+	d, err := newRelayDialer(RelayConfig{Endpoint: "wss://tunnel-psc.example.com/base"})
+	assert.NoError(t, err)
+
+	host := IAPHost{Zone: "us-central1-a"}
+	assert.Equal(t, "wss://tunnel-psc.example.com/base/v4/reconnect?ack=1&newWebsocket=True&sid=abc&zone=us-central1-a", host.reconnectURI(d.endpoint, "abc", 1))
+
+	_, err = newRelayDialer(RelayConfig{Endpoint: "https://tunnel.example.com"})
+	assert.Error(t, err)
+	_, err = newRelayDialer(RelayConfig{Endpoint: "wss://"})
+	assert.Error(t, err)
+}
+
+func TestNewRelayDialerConflicts(t *testing.T) {
+	cases := map[string]RelayConfig{
+		"client with transport":   {HTTPClient: http.DefaultClient, Transport: http.DefaultTransport},
+		"client with TLS":         {HTTPClient: http.DefaultClient, TLSConfig: &tls.Config{}},
+		"transport with timeout":  {Transport: http.DefaultTransport, DialTimeout: time.Second},
+		"negative dial timeout":   {DialTimeout: -time.Second},
+		"negative handshake time": {HandshakeTimeout: -time.Second},
+	}
+
+	for name, cfg := range cases {
+		_, err := newRelayDialer(cfg)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestNewRelayDialerTransport(t *testing.T) {
+	d, err := newRelayDialer(RelayConfig{
+		TLSConfig:        &tls.Config{ServerName: "tunnel.cloudproxy.app"},
+		DialTimeout:      time.Second,
+		HandshakeTimeout: 2 * time.Second,
+	})
+	assert.NoError(t, err)
+
+	transport := d.client.Transport.(*http.Transport)
+	assert.Equal(t, "tunnel.cloudproxy.app", transport.TLSClientConfig.ServerName)
+	assert.Equal(t, 2*time.Second, transport.TLSHandshakeTimeout)
+}
+
+func TestNewRelayDialerClientCertificate(t *testing.T) {
+	cert := &tls.Certificate{Certificate: [][]byte{{0x01}}}
+
+	d, err := newRelayDialer(RelayConfig{ClientCertificate: cert})
+	assert.NoError(t, err)
+	assert.Equal(t, "wss://mtls.tunnel.cloudproxy.app", d.endpoint.String())
+	assert.Len(t, d.client.Transport.(*http.Transport).TLSClientConfig.Certificates, 1)
+
+	d, err = newRelayDialer(RelayConfig{TLSConfig: &tls.Config{Certificates: []tls.Certificate{*cert}}})
+	assert.NoError(t, err)
+	assert.Equal(t, "wss://mtls.tunnel.cloudproxy.app", d.endpoint.String())
+
+	d, err = newRelayDialer(RelayConfig{Endpoint: "wss://tunnel-psc.example.com", ClientCertificate: cert})
+	assert.NoError(t, err)
+	assert.Equal(t, "wss://tunnel-psc.example.com", d.endpoint.String(), "explicit endpoint takes precedence")
+
+	_, err = newRelayDialer(RelayConfig{Transport: http.DefaultTransport, ClientCertificate: cert})
+	assert.Error(t, err)
+}
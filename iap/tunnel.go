@@ -2,45 +2,223 @@ package iap
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coder/websocket"
 	"github.com/nicksulia/go-tcp-over-google-iap/logger"
 	"golang.org/x/oauth2"
 )
 
+// IAPTunnel is a single SSH Relay v4 session. It implements net.Conn, so it can be used wherever a connection
+// to the destination is expected.
+//
+// Ownership of the shared state:
+//   - the read loop (start) owns the session ID and the frame decoder, and replaces the websocket on reconnect;
+//   - the writer loop (writeLoop) is the only goroutine writing frames to the websocket, frames reach it through
+//     outbound. Pings, pongs and close frames are control frames written by the websocket library;
+//   - sendMu guards the replay buffer, the send counters, the connected and write closed flags and the coalescing state;
+//   - receivedMu guards the receive buffer and the receive counters, so Read may be called concurrently.
 type IAPTunnel struct {
 	wsMu                    sync.Mutex
 	ws                      *websocket.Conn
+	localAddr               net.Addr // local address of the current connection to the relay
+	dropReason              error    // why the current websocket was dropped, see dropWS
+	resumeReason            error    // why the session is being resumed until the relay confirms it, owned by the read loop
 	host                    IAPHost
+	relay                   *relayDialer
 	tokenSource             oauth2.TokenSource
+	tokenMu                 sync.Mutex
+	token                   *oauth2.Token // cached until it expires or the relay asks for reauthentication
+	rejectedToken           string        // access token the relay asked to replace, see invalidateToken
+	refreshTimer            *time.Timer   // refreshes the token shortly before it expires
+	sendMu                  sync.Mutex
+	sendCond                *sync.Cond // signalled when the relay acknowledges data or the tunnel is closed
+	sendWindow              uint64     // maximum number of unacknowledged outbound bytes
+	connected               bool
+	writeClosed             bool      // set by CloseWrite
+	sendBuffer              byteQueue // outbound bytes not yet acknowledged by the relay, referenced by queued frames
+	totalBytesSent          uint64
+	totalBytesQueued        uint64 // bytes handed to the writer loop, the rest is held back by write coalescing
 	totalBytesConfirmed     uint64
-	sid                     string
+	coalesceDelay           time.Duration // 0 disables write coalescing
+	flushTimer              *time.Timer   // flushes coalesced bytes after coalesceDelay
+	flushScheduled          bool
+	outbound                chan outboundFrame // frames waiting for the writer loop
+	writerOnce              sync.Once
+	writerDone              chan struct{}
+	sid                     string // owned by the read loop
+	retryPolicy             RetryPolicy
+	connectAttempts         int       // failed attempts to establish the session, owned by the read loop
+	connectDeadline         time.Time // when establishing the session gives up, owned by the read loop
 	logger                  logger.Logger
-	incoming                chan []byte
 	receivedMu              sync.Mutex
+	receivedCond            *sync.Cond // signalled when data is received or read, or the tunnel is closed
+	received                byteQueue  // data not yet returned by Read
+	receiveBuffer           int        // maximum number of bytes in received
 	totalBytesReceived      uint64
+	totalBytesConsumed      uint64 // bytes returned by Read
 	totalBytesReceivedAcked uint64
-	msgBuffer               []byte
+	decoder                 FrameDecoder // owned by the read loop
 	closed                  chan struct{}
+	closeOnce               sync.Once
+	errMu                   sync.Mutex
+	err                     error // terminal error which caused the tunnel to close
 	ready                   chan struct{}
 	readyMu                 sync.RWMutex
+	readDeadline            *deadline
+	writeDeadline           *deadline
+	pingInterval            time.Duration // 0 disables pings
+	pongTimeout             time.Duration
+	readStalled             atomic.Bool   // the read loop waits for room in the receive buffer
+	readStalls              atomic.Uint64 // number of times the read loop stalled
+	idleTimeout             time.Duration // 0 disables the idle timeout
+	lastActivity            atomic.Int64  // unix nanoseconds of the last data sent or received
+	idleMu                  sync.Mutex
+	idleTimer               *time.Timer
 }
 
+var _ net.Conn = (*IAPTunnel)(nil)
+
 // NewIAPTunnel creates a new IAPTunnel instance with the specified host and token source.
-// It initializes the incoming channel for receiving data and sets up channels for closed and ready states.
+// It initializes the send window and receive buffer with their defaults and sets up channels for closed and ready states.
 func NewIAPTunnel(host IAPHost, source oauth2.TokenSource, logger logger.Logger) *IAPTunnel {
-	return &IAPTunnel{
-		host:        host,
-		tokenSource: source,
-		incoming:    make(chan []byte, 1024),
-		closed:      make(chan struct{}),
-		ready:       make(chan struct{}),
-		logger:      logger,
+	t := &IAPTunnel{
+		host:          host,
+		relay:         defaultRelayDialer(),
+		tokenSource:   source,
+		sendWindow:    DefaultSendWindow,
+		retryPolicy:   DefaultRetryPolicy(),
+		pingInterval:  DefaultPingInterval,
+		pongTimeout:   DefaultPongTimeout,
+		outbound:      make(chan outboundFrame, outboundQueueLen),
+		writerDone:    make(chan struct{}),
+		receiveBuffer: DefaultReceiveBuffer,
+		closed:        make(chan struct{}),
+		ready:         make(chan struct{}),
+		logger:        logger,
+	}
+	t.sendCond = sync.NewCond(&t.sendMu)
+	t.receivedCond = sync.NewCond(&t.receivedMu)
+	t.readDeadline = newDeadline(func() {
+		t.receivedMu.Lock()
+		defer t.receivedMu.Unlock()
+		t.receivedCond.Broadcast()
+	})
+	t.writeDeadline = newDeadline(func() {
+		t.sendMu.Lock()
+		defer t.sendMu.Unlock()
+		t.sendCond.Broadcast()
+	})
+	return t
+}
+
+// SetRelayEndpoint sets the base URL of the relay, e.g. "wss://tunnel.example.com" or "ws://127.0.0.1:8080".
+// It must be called before the tunnel is started.
+func (t *IAPTunnel) SetRelayEndpoint(endpoint string) error {
+	return t.SetRelayConfig(RelayConfig{Endpoint: endpoint})
+}
+
+// SetRelayConfig sets the endpoint, HTTP transport, TLS settings and timeouts used to connect to the relay.
+// It must be called before the tunnel is started.
+func (t *IAPTunnel) SetRelayConfig(cfg RelayConfig) error {
+	relay, err := newRelayDialer(cfg)
+	if err != nil {
+		return err
+	}
+
+	t.relay = relay
+	return nil
+}
+
+// SetSendWindow sets the maximum number of outbound bytes which may be in flight without an ACK from the relay.
+// Write blocks once the window is full and resumes as the relay acknowledges data.
+func (t *IAPTunnel) SetSendWindow(size int) error {
+	if size < MinSendWindow {
+		return fmt.Errorf("send window must be at least %d bytes, got %d", MinSendWindow, size)
+	}
+
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	t.sendWindow = uint64(size)
+	t.sendCond.Broadcast()
+	return nil
+}
+
+// SetReceiveBuffer sets the maximum number of received bytes which are buffered until they are read.
+// Once the buffer is full the tunnel stops reading from the relay and delays its ACKs, so the relay stops sending.
+func (t *IAPTunnel) SetReceiveBuffer(size int) error {
+	if size < MinReceiveBuffer {
+		return fmt.Errorf("receive buffer must be at least %d bytes, got %d", MinReceiveBuffer, size)
 	}
+
+	t.receivedMu.Lock()
+	defer t.receivedMu.Unlock()
+	t.receiveBuffer = size
+	t.receivedCond.Broadcast()
+	return nil
+}
+
+// SetCoalesceDelay enables write coalescing. Small writes are held back for up to delay and sent together in data
+// frames of up to MaxMessageSize bytes, a frame is sent as soon as it is full. A delay of 0 disables coalescing,
+// which is the default as it adds latency to interactive sessions such as SSH.
+func (t *IAPTunnel) SetCoalesceDelay(delay time.Duration) error {
+	if delay < 0 {
+		return fmt.Errorf("coalesce delay must not be negative, got %s", delay)
+	}
+
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	t.coalesceDelay = delay
+	return nil
+}
+
+// SetRetryPolicy sets how failures to establish the session are retried. Zero fields select their defaults,
+// see DefaultRetryPolicy. It must be called before the tunnel is started.
+func (t *IAPTunnel) SetRetryPolicy(policy RetryPolicy) error {
+	policy, err := policy.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	t.retryPolicy = policy
+	return nil
+}
+
+// SetPingInterval sets how often the relay is pinged and how long to wait for the pong. If the pong does not arrive
+// in time, the websocket is considered dead and the session is resumed over a new one. An interval of 0 disables pings.
+// It must be called before the tunnel is started.
+func (t *IAPTunnel) SetPingInterval(interval, timeout time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("ping interval must not be negative, got %s", interval)
+	}
+
+	if interval > 0 && timeout <= 0 {
+		return fmt.Errorf("pong timeout must be positive, got %s", timeout)
+	}
+
+	t.pingInterval = interval
+	t.pongTimeout = timeout
+	return nil
+}
+
+// SetIdleTimeout closes the tunnel with ErrIdleTimeout once no data was sent or received for timeout.
+// A timeout of 0 disables it, which is the default. It must be called before the tunnel is started.
+func (t *IAPTunnel) SetIdleTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("idle timeout must not be negative, got %s", timeout)
+	}
+
+	t.idleTimeout = timeout
+	return nil
 }
 
 func (t *IAPTunnel) getWS() *websocket.Conn {
@@ -56,7 +234,7 @@ func (t *IAPTunnel) setWS(ws *websocket.Conn) {
 }
 
 func (t *IAPTunnel) headers() (http.Header, error) {
-	token, err := t.tokenSource.Token()
+	token, err := t.accessToken()
 	if err != nil {
 		return nil, err
 	}
@@ -68,58 +246,87 @@ func (t *IAPTunnel) headers() (http.Header, error) {
 	return h, nil
 }
 
-func (t *IAPTunnel) connectOrReconnect(ctx context.Context) (*websocket.Conn, *http.Response, error) {
-	var err error
-	t.receivedMu.Lock()
-	defer t.receivedMu.Unlock()
+// isConnected is a thread-safe method to check whether outbound data can be sent over the current websocket.
+func (t *IAPTunnel) isConnected() bool {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	return t.connected
+}
 
-	// Reset state for a new connection
-	t.totalBytesReceived = 0
-	t.totalBytesReceivedAcked = 0
-	t.totalBytesConfirmed = 0
-	u := t.host.ConnectURI()
-	t.logger.Info("Connecting/Reconnecting to IAP Tunnel", "URI", u)
+// setConnected is a thread-safe method to mark whether outbound data can be sent over the current websocket.
+func (t *IAPTunnel) setConnected(connected bool) {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	t.connected = connected
+}
 
-	if t.sid != "" {
-		t.ResetReadyAwaiter()
+// connectOrReconnect dials a new IAP tunnel session, or resumes the existing one if a SID has already been received.
+// On resume the relay is told how many bytes were received, so it resends only the missing data.
+func (t *IAPTunnel) connectOrReconnect(ctx context.Context) (*websocket.Conn, *http.Response, error) {
+	var err error
+	var u string
+	if t.sid == "" {
+		u = t.host.connectURI(t.relay.endpoint)
+	} else {
+		t.receivedMu.Lock()
+		// The relay discards everything up to the reconnect ACK, so nothing is left to acknowledge.
+		t.totalBytesReceivedAcked = t.totalBytesReceived
+		u = t.host.reconnectURI(t.relay.endpoint, t.sid, t.totalBytesReceived)
+		t.receivedMu.Unlock()
 	}
+	t.logger.Info("Connecting/Reconnecting to IAP Tunnel", "URI", u)
 
 	headers, err := t.headers()
 	if err != nil {
 		return nil, nil, err
 	}
-	opts := &websocket.DialOptions{
-		HTTPHeader:   headers,
-		Subprotocols: []string{RelayProtocolName},
+	var localAddr net.Addr
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localAddr = info.Conn.LocalAddr()
+		},
 	}
+	nextWS, res, err := t.relay.dial(httptrace.WithClientTrace(ctx, trace), u, headers)
 
-	nextWS, res, err := websocket.Dial(ctx, u, opts)
+	// The tunnel may have been closed while dialing. close() takes the websocket after marking the tunnel closed,
+	// so checking under wsMu guarantees the new websocket is either closed here or by close().
+	t.wsMu.Lock()
+	if t.isClosed() {
+		t.wsMu.Unlock()
+		if nextWS != nil {
+			nextWS.CloseNow()
+		}
+		return nil, res, net.ErrClosed
+	}
 
-	if t.getWS() != nil {
-		prevWS := t.getWS()
-		defer prevWS.Close(websocket.StatusGoingAway, "reconnecting")
+	prevWS := t.ws
+	t.ws = nextWS
+	if err == nil {
+		t.localAddr = localAddr
 	}
+	t.wsMu.Unlock()
 
-	t.setWS(nextWS)
+	if prevWS != nil {
+		prevWS.Close(websocket.StatusGoingAway, "reconnecting")
+	}
 
-	return nextWS, res, err
+	return nextWS, res, relayError(err, res)
 }
 
 // DryRun tests the connection to the IAP tunnel without establishing a full proxy.
 // It attempts to connect to the IAP tunnel and returns any errors encountered.
 func (t *IAPTunnel) DryRun(ctx context.Context) error {
-	_, _, err := t.connectOrReconnect(ctx)
-	if err != nil {
+	defer t.Close()
+	if err := t.connectWithRetry(ctx, nil); err != nil {
 		return err
 	}
 
-	_, _, err = t.getWS().Read(ctx) // Read to ensure connection is established
+	_, _, err := t.getWS().Read(ctx) // Read to ensure connection is established
 	if err != nil {
-		return err
+		return relayError(err, nil)
 	}
 
 	t.logger.Info("Dry run successful, connection established.")
-	t.Close()
 	return nil
 }
 
@@ -131,21 +338,60 @@ func (t *IAPTunnel) Start(ctx context.Context) {
 // start initiates the IAP tunnel connection and begins reading messages.
 // It handles reconnections if the connection is lost.
 func (t *IAPTunnel) start(ctx context.Context) {
-	_, _, err := t.connectOrReconnect(ctx)
-	if err != nil {
+	t.startWriter()
+	t.startKeepAlive()
+	if err := t.connectWithRetry(ctx, nil); err != nil {
 		t.logger.Error("Connect failed", "err", err)
+		t.fail(err)
 		return
 	}
 
+	t.readLoop(ctx)
+}
+
+// connect establishes the session and waits until the relay confirms it with a session ID.
+// ctx only bounds connecting, the session keeps running until the tunnel is closed.
+func (t *IAPTunnel) connect(ctx context.Context) error {
+	t.startWriter()
+	t.startKeepAlive()
+	if err := t.connectWithRetry(ctx, nil); err != nil {
+		t.fail(err)
+		return err
+	}
+
+	go t.readLoop(context.WithoutCancel(ctx))
+	select {
+	case <-t.Ready():
+		return nil
+	case <-t.Done():
+		if err := t.Err(); err != io.EOF {
+			return err
+		}
+		return fmt.Errorf("%w: connection closed before the session was established", ErrProtocol)
+	case <-ctx.Done():
+		t.Close()
+		return ctx.Err()
+	}
+}
+
+// readLoop reads messages from the relay until the tunnel is closed, resuming the session if the websocket is lost.
+func (t *IAPTunnel) readLoop(ctx context.Context) {
 	for {
-		_, msg, err := t.getWS().Read(ctx)
+		ws := t.getWS()
+		if ws == nil {
+			return // closed
+		}
+
+		msg, err := readMessage(ctx, ws)
 
 		select {
-		case <-ctx.Done():
-			t.logger.Info("Context cancelled, stopping read loop")
-			return
 		case <-t.closed:
 			t.logger.Info("Tunnel closed, stopping read loop")
+			ws.CloseNow() // no-op if close() already closes it
+			return
+		case <-ctx.Done():
+			t.logger.Info("Context cancelled, stopping read loop")
+			t.fail(ctx.Err())
 			return
 		default:
 		}
@@ -153,90 +399,382 @@ func (t *IAPTunnel) start(ctx context.Context) {
 		if err != nil {
 			if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
 				t.logger.Info("Websocket closed normally")
+				t.Close()
 				return
 			}
 
-			t.logger.Error("Websocket read error", "err", err)
-			// Attempt reconnect if not context cancellation
-			if ctx.Err() == nil && t.sid != "" {
-				_, _, err = t.connectOrReconnect(ctx)
-				if err != nil {
+			// The relay reports a backend which ended an established session, e.g. SSH after logout, as a failed read
+			if websocket.CloseStatus(err) == CloseStatusDestinationReadFailed && t.sid != "" {
+				t.logger.Info("Backend closed the connection")
+				t.Close()
+				return
+			}
+
+			if reason := t.takeDropReason(ws); reason != nil {
+				err = reason
+				t.resumeReason = reason
+			} else {
+				err = relayError(err, nil)
+			}
+			if errors.Is(err, ErrReauthRequired) {
+				t.logger.Info("Reauthenticating", "reason", err)
+				var closeErr *CloseError
+				if errors.As(err, &closeErr) {
+					t.invalidateToken() // the relay rejected the token, it may not be expired yet
+				}
+			} else {
+				t.logger.Error("Websocket read error", "err", err)
+			}
+			t.setConnected(false)
+			// The relay resends everything after the last complete data frame, a partial frame is obsolete.
+			t.decoder.Reset()
+			// The websocket was lost before the relay confirmed the session, e.g. the relay failed to reach the target
+			if ctx.Err() == nil && t.sid == "" {
+				if err = t.connectWithRetry(ctx, err); err != nil {
+					t.logger.Error("Connect failed", "err", err)
+					t.fail(dropError(t.resumeReason, err))
+					return
+				}
+
+				continue
+			}
+
+			// Attempt reconnect if not context cancellation, unless the relay rejected the session for good
+			if ctx.Err() == nil && t.sid != "" && (isRetryable(err) || errors.Is(err, ErrReauthRequired)) {
+				if err = t.reconnect(ctx); err != nil {
 					t.logger.Error("Reconnect failed", "err", err)
+					t.fail(dropError(t.resumeReason, err))
 					return
 				}
 
 				continue
 			}
 
+			t.fail(dropError(t.resumeReason, err))
 			return
 		}
 
-		t.handleFrame(NewIncomingFrame(msg))
+		frames, err := t.decoder.Decode(*msg)
+		if err == nil && isHungMessage(frames) {
+			// The relay sends this message when the session hangs, it recovers on a new websocket
+			putMessageBuffer(msg)
+			t.logger.Warn("Relay reported a hung session, dropping websocket")
+			t.dropWS(ws, ErrSessionHung)
+			continue
+		}
+
+		for _, frame := range frames {
+			t.handleFrame(frame)
+		}
+		putMessageBuffer(msg) // frames are handled, data was copied into the receive buffer
+
+		if err != nil {
+			t.logger.Error("Malformed frame received", "err", err)
+			t.failWithStatus(err, CloseStatusInvalidData)
+			return
+		}
+	}
+}
+
+// dropError keeps the reason a websocket was dropped, e.g. ErrPingTimeout, when the session can not be resumed.
+// reason is nil if the session was not resumed after a drop.
+func dropError(reason, err error) error {
+	if reason == nil || errors.Is(err, reason) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", reason, err)
+}
+
+// isHungMessage reports whether a message holds nothing but the HangedMessageLen bytes the relay sends for a hung session.
+func isHungMessage(frames []Frame) bool {
+	if len(frames) != 1 {
+		return false
+	}
+
+	f, ok := frames[0].(*UnknownFrame)
+	return ok && f.Len() == HangedMessageLen
+}
+
+// readMessage reads the next websocket message into a pooled buffer, which must be returned with putMessageBuffer.
+func readMessage(ctx context.Context, ws *websocket.Conn) (*[]byte, error) {
+	_, r, err := ws.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := getMessageBuffer()
+	b := *msg
+	for {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)] // the relay may pack several frames into one message
+		}
+
+		var n int
+		n, err = r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err != nil {
+			break
+		}
+	}
+
+	*msg = b
+	if err != io.EOF {
+		putMessageBuffer(msg)
+		return nil, err
+	}
+	return msg, nil
+}
+
+// connectWithRetry establishes a new session. Transient failures are retried with backoff according to the retry
+// policy, other failures are returned right away. err is the failure of the previous attempt, if there was one.
+func (t *IAPTunnel) connectWithRetry(ctx context.Context, err error) error {
+	if t.connectDeadline.IsZero() {
+		t.connectDeadline = t.retryPolicy.deadline(time.Now())
+	}
+
+	for {
+		if err != nil {
+			t.connectAttempts++
+			if ctx.Err() != nil || !isRetryable(err) {
+				return err
+			}
+
+			if t.connectAttempts >= t.retryPolicy.MaxAttempts {
+				return fmt.Errorf("failed to connect after %d attempts: %w", t.connectAttempts, err)
+			}
+
+			delay := t.retryPolicy.backoff(t.connectAttempts)
+			if !t.connectDeadline.IsZero() && time.Now().Add(delay).After(t.connectDeadline) {
+				return fmt.Errorf("failed to connect within %s: %w", t.retryPolicy.Timeout, err)
+			}
+
+			t.logger.Warn("Connect attempt failed, retrying", "attempt", t.connectAttempts, "delay", delay, "err", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-t.closed:
+				return net.ErrClosed
+			case <-time.After(delay):
+			}
+		}
+
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if !t.connectDeadline.IsZero() {
+			dialCtx, cancel = context.WithDeadline(ctx, t.connectDeadline)
+		}
+		_, _, err = t.connectOrReconnect(dialCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+}
+
+// reconnect tries to resume the current session, backing off between failed attempts.
+// Failures which would fail the same way again, e.g. ErrSessionLost or ErrNotAuthorized, are returned right away.
+func (t *IAPTunnel) reconnect(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		_, _, err := t.connectOrReconnect(ctx)
+		if err == nil {
+			return nil
+		}
+
+		// The token source still caches the rejected token, a fresh one is only issued once it expires
+		var rejected *tokenRejectedError
+		if errors.As(err, &rejected) && rejected.wait() > 0 {
+			t.logger.Warn("Token source returned the rejected access token, waiting for it to expire", "expiry", rejected.expiry)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-t.closed:
+				return net.ErrClosed
+			case <-time.After(rejected.wait()):
+			}
+
+			attempt--
+			continue
+		}
+
+		if !isRetryable(err) {
+			return err
+		}
+
+		if attempt >= reconnectAttempts {
+			return fmt.Errorf("failed to resume session after %d attempts: %w", attempt, err)
+		}
+
+		t.logger.Warn("Reconnect attempt failed", "attempt", attempt, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.closed:
+			return net.ErrClosed
+		case <-time.After(time.Second * time.Duration(attempt)):
+		}
 	}
 }
 
 // handleFrame processes incoming frames based on their type.
-func (t *IAPTunnel) handleFrame(frame *IncomingFrame) {
-	switch frame.Type() {
-	case RelayConnectSuccessSID:
-		t.handleConnectSuccessSID(frame)
-	case RelayReconnectSuccessACK:
-		t.handleReconnectSuccessACK(frame)
-	case RelayACK:
-		t.handleACK(frame)
-	case RelayData:
-		t.handleData(frame)
+func (t *IAPTunnel) handleFrame(frame Frame) {
+	switch f := frame.(type) {
+	case *ConnectSuccessSIDFrame:
+		t.handleConnectSuccessSID(f)
+	case *ReconnectSuccessACKFrame:
+		t.handleReconnectSuccessACK(f)
+	case *RelayACKFrame:
+		t.handleACK(f)
+	case *RelayDataFrame:
+		t.handleData(f)
 	default:
-		t.logger.Warn("Unknown frame type: ", frame.Type())
+		t.logger.Warn("Unknown frame type, discarding", "tag", frame.Tag(), "Length", frame.Len())
 	}
 }
 
 // handleConnectSuccessSID processes incoming connect success SID frames.
-func (t *IAPTunnel) handleConnectSuccessSID(frame *IncomingFrame) {
-	t.sid = frame.SID()
+func (t *IAPTunnel) handleConnectSuccessSID(frame *ConnectSuccessSIDFrame) {
+	t.sid = frame.SID
 	t.logger.Info("Connect success")
 	t.logger.Debug("Session Details", "SID", t.sid)
+	t.resumeReason = nil
+	t.setConnected(true)
 	t.EnsureReady()
 }
 
 // handleReconnectSuccessACK processes incoming reconnect success ACK frames.
-func (t *IAPTunnel) handleReconnectSuccessACK(frame *IncomingFrame) {
-	t.totalBytesConfirmed = frame.ACK()
-	t.logger.Debug("Reconnect success", "ACK Bytes", t.totalBytesConfirmed)
+// The ACK tells how many outbound bytes reached the relay before the connection was lost, everything after it is resent.
+func (t *IAPTunnel) handleReconnectSuccessACK(frame *ReconnectSuccessACKFrame) {
+	ack := frame.ACK
+	t.logger.Info("Reconnect success")
+	t.logger.Debug("Session Details", "SID", t.sid, "ACK Bytes", ack)
+	t.resumeReason = nil
+	if err := t.resume(ack); err != nil {
+		t.logger.Error("Failed to resume session", "err", err)
+		t.fail(err)
+	}
 }
 
 // handleACK processes incoming ACK frames.
-func (t *IAPTunnel) handleACK(frame *IncomingFrame) {
-	t.totalBytesConfirmed = frame.ACK()
-	t.logger.Debug("ACK received", "ACK Bytes", t.totalBytesConfirmed)
+func (t *IAPTunnel) handleACK(frame *RelayACKFrame) {
+	ack := frame.ACK
+	t.sendMu.Lock()
+	err := t.confirm(ack)
+	t.sendMu.Unlock()
+	if err != nil {
+		t.logger.Error("Failed to confirm sent data", "err", err)
+		t.fail(err)
+	}
+}
+
+// confirm drops the bytes acknowledged by the relay from the replay buffer.
+// Must be called with sendMu held.
+func (t *IAPTunnel) confirm(ack uint64) error {
+	if ack < t.totalBytesConfirmed || ack > t.totalBytesSent {
+		return fmt.Errorf("%w: invalid ACK %d, expected value between %d and %d", ErrProtocol, ack, t.totalBytesConfirmed, t.totalBytesSent)
+	}
+
+	// The relay only acknowledges bytes it has received, so no queued frame references them anymore
+	t.sendBuffer.Discard(int(ack - t.totalBytesConfirmed))
+	t.totalBytesConfirmed = ack
+	t.totalBytesQueued = max(t.totalBytesQueued, ack)
+	t.sendCond.Broadcast()
+	return nil
+}
+
+// awaitSendWindow blocks until there is room in the send window and returns the number of bytes that may be sent.
+// Must be called with sendMu held.
+func (t *IAPTunnel) awaitSendWindow() (int, error) {
+	for {
+		select {
+		case <-t.closed:
+			return 0, t.closeErr()
+		default:
+		}
+
+		if t.writeDeadline.exceeded() {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if t.writeClosed {
+			return 0, io.ErrClosedPipe
+		}
+
+		inFlight := t.totalBytesSent - t.totalBytesConfirmed
+		if inFlight < t.sendWindow {
+			return int(t.sendWindow - inFlight), nil
+		}
+
+		t.logger.Debug("Send window is full, waiting for ACK", "In Flight", inFlight)
+		t.sendCond.Wait()
+	}
+}
+
+// resume confirms the bytes received by the relay and resends the rest of the replay buffer over the new websocket.
+func (t *IAPTunnel) resume(ack uint64) error {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	if err := t.confirm(ack); err != nil {
+		return err
+	}
+
+	// Queued under sendMu, so the replayed data is written before anything passed to Write later on
+	t.totalBytesQueued = t.totalBytesConfirmed
+	if err := t.flush(true, nil); err != nil {
+		return fmt.Errorf("failed to resend unacknowledged data: %w", err)
+	}
+
+	t.logger.Debug("Resent unacknowledged data", "Length", t.sendBuffer.Len())
+	t.connected = true
+	return nil
 }
 
 // handleData processes incoming data frames.
-func (t *IAPTunnel) handleData(frame *IncomingFrame) {
-	data, rest := frame.Data()
-	// Process the data as needed
-	t.logger.Debug("Data received", "Data Length", len(data), "binary_data[:20]", frame.data[:20])
-	if data != nil {
-		t.incoming <- data
-		t.receivedMu.Lock()
-		defer t.receivedMu.Unlock()
-		t.totalBytesReceived += uint64(len(data))
-		// gcloud iap-tunnel client sends ACKs for every MaxMessageSize * 2  bytes received
-		if t.totalBytesReceived-t.totalBytesReceivedAcked > MaxMessageSize*2 {
-			_, err := NewACKFrame(t.totalBytesReceived, t.logger).Send(t.getWS())
-			if err != nil {
-				t.logger.Debug("Failed to send ACK frame", "err", err)
-				return
-			}
+// It blocks the read loop while the receive buffer is full, which stops reading from the relay until Read catches up.
+func (t *IAPTunnel) handleData(frame *RelayDataFrame) {
+	data := frame.Data
+	if len(data) == 0 {
+		return
+	}
+
+	t.receivedMu.Lock()
+	defer t.receivedMu.Unlock()
+	// A single frame is always accepted into an empty buffer, so a frame larger than the buffer can not stall the tunnel
+	for t.received.Len() > 0 && t.received.Len()+len(data) > t.receiveBuffer {
+		if t.isClosed() {
+			t.readStalled.Store(false)
+			return
+		}
 
-			t.totalBytesReceivedAcked = t.totalBytesReceived
+		if !t.readStalled.Load() {
+			t.readStalls.Add(1)
+			t.readStalled.Store(true) // pongs are not read until Read makes room
 		}
+		t.logger.Debug("Receive buffer is full, waiting for Read", "Buffered", t.received.Len())
+		t.receivedCond.Wait()
+	}
+	t.readStalled.Store(false)
+
+	t.touch()
+	t.received.Write(data)
+	t.totalBytesReceived += uint64(len(data))
+	t.receivedCond.Broadcast()
+}
+
+// acknowledge tells the relay how many bytes were consumed by Read. The relay limits the number of unacknowledged
+// bytes, so ACKing only what was read pushes back on the relay while the local reader is slow.
+// Must be called with receivedMu held.
+func (t *IAPTunnel) acknowledge() {
+	// gcloud iap-tunnel client sends ACKs for every MaxMessageSize * 2  bytes received
+	if t.totalBytesConsumed <= t.totalBytesReceivedAcked || t.totalBytesConsumed-t.totalBytesReceivedAcked <= MaxMessageSize*2 {
+		return
 	}
 
-	// If there is additional data, handle it accordingly
-	if len(rest) > 0 {
-		t.logger.Debug("Discard additional data received after main payload", "Length", len(rest))
+	// Queued under receivedMu, so concurrent readers can not reorder ACKs
+	if err := t.enqueueACK(t.totalBytesConsumed); err != nil {
+		t.logger.Debug("Failed to queue ACK frame", "err", err)
+		return
 	}
+
+	t.totalBytesReceivedAcked = t.totalBytesConsumed
 }
 
 // Ready returns a channel that is closed when the tunnel is ready to accept data.
@@ -246,6 +784,21 @@ func (t *IAPTunnel) Ready() <-chan struct{} {
 	return t.ready
 }
 
+// Done returns a channel that is closed when the tunnel has ended, whether it was closed by Close, the relay
+// closed the session, connecting failed or the context passed to Start was cancelled. See Err for the reason.
+func (t *IAPTunnel) Done() <-chan struct{} {
+	return t.closed
+}
+
+// Err returns nil while the tunnel is open. Once Done is closed, it returns the error which terminated the tunnel,
+// e.g. a *CloseError for "failed to connect to backend (4003)", or io.EOF if the tunnel was closed gracefully.
+func (t *IAPTunnel) Err() error {
+	if !t.isClosed() {
+		return nil
+	}
+	return t.closeErr()
+}
+
 func (t *IAPTunnel) ResetReadyAwaiter() {
 	t.readyMu.Lock()
 	defer t.readyMu.Unlock()
@@ -264,75 +817,329 @@ func (t *IAPTunnel) EnsureReady() {
 }
 
 // Read implements the io.Reader interface for IAPTunnel.
+// Data received before the tunnel was closed is still returned, the close error is returned once it is drained.
+// Once the read deadline has passed Read fails with os.ErrDeadlineExceeded.
 func (t *IAPTunnel) Read(p []byte) (int, error) {
 	select {
 	case <-t.closed:
-		return 0, io.EOF
+	case <-t.readDeadline.wait():
 	case <-t.Ready():
-		// Serve any pending data first
-		if len(t.msgBuffer) > 0 {
-			n := copy(p, t.msgBuffer)
-			t.msgBuffer = t.msgBuffer[n:]
-			return n, nil
+	}
+
+	t.receivedMu.Lock()
+	defer t.receivedMu.Unlock()
+	for {
+		if t.readDeadline.exceeded() {
+			return 0, os.ErrDeadlineExceeded
 		}
 
-		data, ok := <-t.incoming
-		if !ok {
-			return 0, io.EOF
+		if t.received.Len() > 0 {
+			break
 		}
 
-		n := copy(p, data)
-		// buffer is empty, so we can copy the data directly
-		t.msgBuffer = data[n:]
-		return n, nil
+		if t.isClosed() {
+			return 0, t.closeErr()
+		}
+		t.receivedCond.Wait()
 	}
+
+	n := t.received.Read(p)
+	t.totalBytesConsumed += uint64(n)
+	t.acknowledge()
+	t.receivedCond.Broadcast()
+	return n, nil
 }
 
 // Write implements the io.Writer interface for IAPTunnel.
+// Data is handed to the writer loop, so Write returns before it reaches the relay. Written bytes are kept in
+// the replay buffer until the relay acknowledges them. While the session is being resumed, data is only
+// buffered and is sent once the relay reports how much it has received. With write coalescing enabled, see
+// SetCoalesceDelay, small writes are held back until a frame is full or the coalesce delay has passed.
+// Write blocks while the number of unacknowledged bytes exceeds the send window. Once the write deadline has
+// passed Write fails with os.ErrDeadlineExceeded, the returned count covers the bytes which will still be sent.
 func (t *IAPTunnel) Write(p []byte) (n int, err error) {
+	if t.writeDeadline.exceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
 	select {
 	case <-t.closed:
-		return 0, io.EOF
+		return 0, t.closeErr()
+	case <-t.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
 	case <-t.Ready():
+		t.sendMu.Lock()
+		defer t.sendMu.Unlock()
+		defer func() {
+			if t.connected && t.coalesceDelay > 0 && t.totalBytesQueued < t.totalBytesSent {
+				t.scheduleFlush()
+			}
+		}()
+
 		payloadLen := len(p)
 		totalSent := 0
 
 		for totalSent < len(p) {
-			chunkEnd := totalSent + MaxMessageSize
+			available, err := t.awaitSendWindow()
+			if err != nil {
+				return totalSent, err
+			}
+
+			chunkEnd := totalSent + min(MaxMessageSize, available)
 			if chunkEnd > payloadLen {
 				chunkEnd = payloadLen
 			}
 
 			// Avoid slicing multiple times
 			chunk := p[totalSent:chunkEnd]
-			frame := NewDataFrame(chunk, t.logger)
+			t.touch()
+			t.sendBuffer.Write(chunk)
+			t.totalBytesSent += uint64(len(chunk))
+			totalSent += len(chunk)
 
-			var sent int
-			var sendErr error
-			if sent, sendErr = frame.Send(t.ws); sendErr != nil {
-				return totalSent, sendErr
+			if !t.connected {
+				continue // chunk is resent after reconnect
 			}
 
-			totalSent += sent
+			if err := t.flush(t.coalesceDelay == 0, t.writeDeadline.wait()); err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					totalSent -= t.discardUnqueued(totalSent)
+				}
+				return totalSent, err
+			}
 		}
 
 		return totalSent, nil
 	}
 }
 
-// Close implements the io.Closer interface for IAPTunnel.
-func (t *IAPTunnel) Close() error {
+// CloseWrite shuts down the sending side of the tunnel like net.TCPConn.CloseWrite, data from the relay is still
+// received until the relay ends the stream. Bytes held back by write coalescing are sent, later writes fail with
+// io.ErrClosedPipe. SSH Relay v4 has no frame to signal the end of the stream, so the destination only sees EOF
+// once the tunnel is closed.
+func (t *IAPTunnel) CloseWrite() error {
+	if t.isClosed() {
+		return net.ErrClosed
+	}
+
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	if t.writeClosed {
+		return nil
+	}
+
+	t.writeClosed = true
+	t.sendCond.Broadcast() // fail writers waiting for the send window
+	if !t.connected {
+		return nil // everything is sent once the session is resumed
+	}
+	return t.flush(true, nil)
+}
+
+// LocalAddr returns the local address of the connection to the relay.
+// It is an unspecified TCP address until the tunnel is connected.
+func (t *IAPTunnel) LocalAddr() net.Addr {
+	t.wsMu.Lock()
+	defer t.wsMu.Unlock()
+	if t.localAddr == nil {
+		return &net.TCPAddr{}
+	}
+	return t.localAddr
+}
+
+// RemoteAddr returns a synthetic address describing the destination of the tunnel.
+func (t *IAPTunnel) RemoteAddr() net.Addr {
+	return &IAPAddr{Host: t.host}
+}
+
+// SetDeadline sets the read and write deadlines, see net.Conn.
+func (t *IAPTunnel) SetDeadline(deadline time.Time) error {
+	t.readDeadline.set(deadline)
+	t.writeDeadline.set(deadline)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for pending and future Read calls, a zero value disables it.
+func (t *IAPTunnel) SetReadDeadline(deadline time.Time) error {
+	t.readDeadline.set(deadline)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for pending and future Write calls, a zero value disables it.
+// Bytes returned as written by a Write which hit the deadline are still sent.
+func (t *IAPTunnel) SetWriteDeadline(deadline time.Time) error {
+	t.writeDeadline.set(deadline)
+	return nil
+}
+
+// Flush sends the bytes held back by write coalescing without waiting for the coalesce delay.
+// It fails with os.ErrDeadlineExceeded once the write deadline has passed, the bytes are sent later on.
+func (t *IAPTunnel) Flush() error {
+	return t.flushHeldBack(t.writeDeadline.wait())
+}
+
+// flushHeldBack sends the bytes held back by write coalescing, blocking until they are queued or cancel is closed.
+func (t *IAPTunnel) flushHeldBack(cancel <-chan struct{}) error {
+	if t.isClosed() {
+		return t.closeErr()
+	}
+
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	if !t.connected {
+		return nil // everything is sent once the session is resumed
+	}
+	return t.flush(true, cancel)
+}
+
+// flush hands the buffered bytes which were not queued yet to the writer loop. Unless all is set, bytes in the
+// last chunk of the replay buffer are held back until the chunk is full, so they are sent in a single frame.
+// Frames reference the replay buffer instead of a copy of the data. Queuing stops once cancel is closed.
+// Must be called with sendMu held.
+func (t *IAPTunnel) flush(all bool, cancel <-chan struct{}) error {
+	from := int(t.totalBytesQueued - t.totalBytesConfirmed)
+	to := t.sendBuffer.Len()
+	if !all {
+		to = t.sendBuffer.Filled()
+	}
+	if to <= from {
+		return nil
+	}
+
+	return t.sendBuffer.Slices(from, to, func(payload []byte) error {
+		if err := t.enqueueData(payload, cancel); err != nil {
+			return err
+		}
+		t.totalBytesQueued += uint64(len(payload))
+		return nil
+	})
+}
+
+// discardUnqueued drops up to limit bytes from the end of the replay buffer which were not handed to the
+// writer loop yet, and returns how many were dropped. Write uses it to give back the bytes of a call which
+// hit the write deadline, bytes held back by earlier calls are kept.
+// Must be called with sendMu held.
+func (t *IAPTunnel) discardUnqueued(limit int) int {
+	n := min(int(t.totalBytesSent-t.totalBytesQueued), limit)
+	t.sendBuffer.Truncate(n)
+	t.totalBytesSent -= uint64(n)
+	return n
+}
+
+// scheduleFlush arms the timer which flushes coalesced bytes.
+// Must be called with sendMu held.
+func (t *IAPTunnel) scheduleFlush() {
+	if t.flushScheduled {
+		return
+	}
+
+	t.flushScheduled = true
+	if t.flushTimer == nil {
+		t.flushTimer = time.AfterFunc(t.coalesceDelay, t.flushCoalesced)
+		return
+	}
+	t.flushTimer.Reset(t.coalesceDelay)
+}
+
+// flushCoalesced runs once the coalesce delay has passed.
+func (t *IAPTunnel) flushCoalesced() {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	t.flushScheduled = false
+	if !t.connected || t.isClosed() {
+		return
+	}
+
+	if err := t.flush(true, nil); err != nil {
+		t.logger.Debug("Failed to flush coalesced data", "err", err)
+	}
+}
+
+// fail records the error which terminated the tunnel and closes it.
+// Only the first error is kept, it is returned by subsequent Read and Write calls.
+func (t *IAPTunnel) fail(err error) {
+	t.failWithStatus(err, CloseStatusNormal)
+}
+
+// failWithStatus records the error which terminated the tunnel and closes the websocket with the given status code.
+// A tunnel which has already been closed keeps its state, e.g. io.EOF after Close.
+func (t *IAPTunnel) failWithStatus(err error, code websocket.StatusCode) {
+	t.errMu.Lock()
+	if t.err == nil && !t.isClosed() {
+		t.err = err
+	}
+	t.errMu.Unlock()
+	t.close(code, err.Error())
+}
+
+// isClosed reports whether the tunnel has been closed.
+func (t *IAPTunnel) isClosed() bool {
 	select {
 	case <-t.closed:
-		return nil // already closed
+		return true
 	default:
+		return false
+	}
+}
+
+// closeErr returns the error which terminated the tunnel, or io.EOF if it was closed gracefully.
+func (t *IAPTunnel) closeErr() error {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	return io.EOF
+}
+
+// Close implements the io.Closer interface for IAPTunnel.
+// Bytes held back by write coalescing are flushed first, unless the writer loop is stuck for flushTimeout.
+func (t *IAPTunnel) Close() error {
+	if !t.isClosed() {
+		ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+		defer cancel()
+		if err := t.flushHeldBack(ctx.Done()); err != nil {
+			t.logger.Debug("Failed to flush coalesced data", "err", err)
+		}
+	}
+	return t.close(CloseStatusNormal, "closing IAP tunnel")
+}
+
+// close closes the tunnel and its websocket with the given status code and reason.
+func (t *IAPTunnel) close(code websocket.StatusCode, reason string) error {
+	closing := false
+	t.closeOnce.Do(func() {
+		closing = true
 		close(t.closed)
+	})
+	if !closing {
+		return nil // already closed
 	}
 
+	t.stopIdleTimer()
+	t.stopTokenRefresh()
+
+	// Wake up Read and the read loop waiting for room in the receive buffer
+	t.receivedMu.Lock()
+	t.receivedCond.Broadcast()
+	t.receivedMu.Unlock()
+
+	// Let the writer loop flush the queued frames before the websocket goes away
+	t.stopWriter()
+
+	var err error
 	ws := t.getWS()
 	if ws != nil {
 		t.setWS(nil)
-		return ws.Close(websocket.StatusNormalClosure, "closing IAP tunnel")
+		err = ws.Close(code, closeReason(reason))
 	}
-	return nil
+
+	// Wake up writers waiting for the send window
+	t.sendMu.Lock()
+	if t.flushTimer != nil {
+		t.flushTimer.Stop()
+	}
+	t.sendCond.Broadcast()
+	t.sendMu.Unlock()
+	return err
 }
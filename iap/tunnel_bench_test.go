@@ -0,0 +1,125 @@
+package iap
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coder/websocket"
+	"github.com/nicksulia/go-tcp-over-google-iap/logger"
+)
+
+const benchmarkSize = 1024 * 1024
+
+// startSink starts a websocket server which discards data frames and counts their payload bytes.
+func startSink(b *testing.B) (*websocket.Conn, *atomic.Uint64) {
+	var received atomic.Uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+
+		buf := make([]byte, DataMessageHeaderLen+MaxMessageSize)
+		for {
+			_, reader, err := ws.Reader(context.Background())
+			if err != nil {
+				return
+			}
+
+			n := 0
+			for err == nil {
+				var read int
+				read, err = reader.Read(buf[n:])
+				n += read
+			}
+
+			if err != io.EOF {
+				return
+			}
+			received.Add(uint64(n - DataMessageHeaderLen))
+		}
+	}))
+	b.Cleanup(server.Close)
+
+	ws, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ws.CloseNow() })
+	return ws, &received
+}
+
+// BenchmarkSendPath measures Write and the writer loop, allocations are reported per MB.
+func BenchmarkSendPath(b *testing.B) {
+	log, _ := logger.NewZapLogger("error")
+	tunnel := NewIAPTunnel(IAPHost{}, nil, log)
+	ws, received := startSink(b)
+	tunnel.setWS(ws)
+	tunnel.setConnected(true)
+	tunnel.EnsureReady()
+	tunnel.startWriter()
+	b.Cleanup(func() { tunnel.Close() })
+
+	payload := make([]byte, benchmarkSize)
+	b.SetBytes(benchmarkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tunnel.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+
+		sent := uint64(i+1) * benchmarkSize
+		for received.Load() < sent { // only data which reached the sink may be acknowledged
+			runtime.Gosched()
+		}
+		tunnel.handleACK(&RelayACKFrame{ACK: sent})
+	}
+}
+
+// BenchmarkReceivePath measures decoding data frames, buffering them and Read, allocations are reported per MB.
+func BenchmarkReceivePath(b *testing.B) {
+	log, _ := logger.NewZapLogger("error")
+	tunnel := NewIAPTunnel(IAPHost{}, nil, log)
+	tunnel.EnsureReady()
+	go func() {
+		for range tunnel.outbound { // discard ACKs
+		}
+	}()
+
+	msg := make([]byte, DataMessageHeaderLen+MaxMessageSize)
+	binary.BigEndian.PutUint16(msg, RelayData)
+	binary.BigEndian.PutUint32(msg[MessageTagLen:], MaxMessageSize)
+	buf := make([]byte, 32*1024)
+
+	b.SetBytes(benchmarkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for received := 0; received < benchmarkSize; received += MaxMessageSize {
+			frames, err := tunnel.decoder.Decode(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, frame := range frames {
+				tunnel.handleFrame(frame)
+			}
+
+			for read := 0; read < MaxMessageSize; {
+				n, err := tunnel.Read(buf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				read += n
+			}
+		}
+	}
+}
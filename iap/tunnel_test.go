@@ -0,0 +1,381 @@
+package iap
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nicksulia/go-tcp-over-google-iap/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmTrimsReplayBuffer(t *testing.T) {
+	tunnel := NewIAPTunnel(IAPHost{}, nil, nil)
+	tunnel.sendBuffer.Write([]byte("hello world"))
+	tunnel.totalBytesSent = 11
+
+	assert.NoError(t, tunnel.confirm(6))
+	assert.Equal(t, []byte("world"), queuedBytes(&tunnel.sendBuffer))
+	assert.Equal(t, uint64(6), tunnel.totalBytesConfirmed)
+
+	assert.NoError(t, tunnel.confirm(11))
+	assert.Zero(t, tunnel.sendBuffer.Len())
+
+	assert.Error(t, tunnel.confirm(5), "ACK below the confirmed offset must be rejected")
+	assert.Error(t, tunnel.confirm(12), "ACK beyond the sent offset must be rejected")
+}
+
+func TestWriteBlocksOnFullSendWindow(t *testing.T) {
+	log, _ := logger.NewZapLogger("error")
+	tunnel := NewIAPTunnel(IAPHost{}, nil, log)
+	tunnel.EnsureReady()
+	assert.NoError(t, tunnel.SetSendWindow(MinSendWindow))
+
+	payload := make([]byte, MinSendWindow+10)
+	done := make(chan int)
+	go func() {
+		n, _ := tunnel.Write(payload)
+		done <- n
+	}()
+
+	assert.Eventually(t, func() bool {
+		tunnel.sendMu.Lock()
+		defer tunnel.sendMu.Unlock()
+		return tunnel.totalBytesSent == MinSendWindow
+	}, time.Second, time.Millisecond, "Write should fill the send window")
+
+	select {
+	case <-done:
+		t.Fatal("Write should block until the relay acknowledges data")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tunnel.handleACK(&RelayACKFrame{ACK: MinSendWindow})
+	assert.Equal(t, len(payload), <-done)
+}
+
+func TestSetSendWindowRejectsSmallWindow(t *testing.T) {
+	tunnel := NewIAPTunnel(IAPHost{}, nil, nil)
+	assert.Error(t, tunnel.SetSendWindow(MaxMessageSize))
+}
+
+func TestHandleDataBlocksOnFullReceiveBuffer(t *testing.T) {
+	log, _ := logger.NewZapLogger("error")
+	tunnel := NewIAPTunnel(IAPHost{}, nil, log)
+	tunnel.EnsureReady()
+	assert.NoError(t, tunnel.SetReceiveBuffer(MinReceiveBuffer))
+
+	frame := &RelayDataFrame{Data: make([]byte, MaxMessageSize)}
+	for i := 0; i < MinReceiveBuffer/MaxMessageSize; i++ {
+		tunnel.handleData(frame)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tunnel.handleData(frame)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("handleData should block until the buffer is read")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	n, err := tunnel.Read(make([]byte, MaxMessageSize))
+	assert.NoError(t, err)
+	assert.Equal(t, MaxMessageSize, n)
+	<-done
+
+	tunnel.receivedMu.Lock()
+	assert.Equal(t, MinReceiveBuffer, tunnel.received.Len())
+	assert.Equal(t, uint64(MaxMessageSize), tunnel.totalBytesConsumed)
+	tunnel.receivedMu.Unlock()
+}
+
+func TestCloseUnblocksReceivePath(t *testing.T) {
+	log, _ := logger.NewZapLogger("error")
+	tunnel := NewIAPTunnel(IAPHost{}, nil, log)
+	tunnel.EnsureReady()
+	assert.NoError(t, tunnel.SetReceiveBuffer(MinReceiveBuffer))
+
+	frame := &RelayDataFrame{Data: make([]byte, MinReceiveBuffer)}
+	tunnel.handleData(frame)
+
+	done := make(chan struct{})
+	go func() {
+		tunnel.handleData(frame) // blocked by the full buffer
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, tunnel.Close())
+	<-done
+
+	// Data received before the close is still returned
+	n, err := io.ReadFull(tunnel, make([]byte, MinReceiveBuffer))
+	assert.NoError(t, err)
+	assert.Equal(t, MinReceiveBuffer, n)
+	_, err = tunnel.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadAcknowledgesConsumedData(t *testing.T) {
+	log, _ := logger.NewZapLogger("error")
+	tunnel := NewIAPTunnel(IAPHost{}, nil, log)
+	tunnel.EnsureReady()
+
+	for i := 0; i < 4; i++ {
+		tunnel.handleData(&RelayDataFrame{Data: make([]byte, MaxMessageSize)})
+	}
+	assert.Empty(t, tunnel.outbound, "nothing is acknowledged before it is read")
+
+	_, err := io.ReadFull(tunnel, make([]byte, 3*MaxMessageSize))
+	assert.NoError(t, err)
+	if assert.Len(t, tunnel.outbound, 1) {
+		f := <-tunnel.outbound
+		assert.Equal(t, RelayACK, f.tag)
+		assert.Equal(t, uint64(3*MaxMessageSize), f.ack)
+	}
+}
+
+func TestSetReceiveBufferRejectsSmallBuffer(t *testing.T) {
+	tunnel := NewIAPTunnel(IAPHost{}, nil, nil)
+	assert.Error(t, tunnel.SetReceiveBuffer(MaxMessageSize))
+}
+
+// connectedTunnel returns a tunnel which queues frames without a writer loop, so tests can inspect them.
+func connectedTunnel(t *testing.T) *IAPTunnel {
+	log, _ := logger.NewZapLogger("error")
+	tunnel := NewIAPTunnel(IAPHost{}, nil, log)
+	tunnel.EnsureReady()
+	tunnel.setConnected(true)
+	t.Cleanup(func() { tunnel.close(CloseStatusNormal, "") })
+	return tunnel
+}
+
+// queuedPayloads drains the outbound queue and returns the payload sizes of the queued data frames.
+func queuedPayloads(tunnel *IAPTunnel) []int {
+	var sizes []int
+	for len(tunnel.outbound) > 0 {
+		if f := <-tunnel.outbound; f.tag == RelayData {
+			sizes = append(sizes, len(f.payload))
+		}
+	}
+	return sizes
+}
+
+func TestWriteWithoutCoalescing(t *testing.T) {
+	tunnel := connectedTunnel(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := tunnel.Write([]byte("ls\n"))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []int{3, 3, 3}, queuedPayloads(tunnel), "every write is sent right away")
+}
+
+func TestWriteCoalescesSmallWrites(t *testing.T) {
+	tunnel := connectedTunnel(t)
+	assert.NoError(t, tunnel.SetCoalesceDelay(time.Hour))
+
+	for i := 0; i < 10; i++ {
+		_, err := tunnel.Write(make([]byte, 100))
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, queuedPayloads(tunnel), "small writes are held back")
+
+	_, err := tunnel.Write(make([]byte, MaxMessageSize))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{MaxMessageSize}, queuedPayloads(tunnel), "a full frame is sent right away")
+
+	assert.NoError(t, tunnel.Flush())
+	assert.Equal(t, []int{1000}, queuedPayloads(tunnel))
+	assert.Equal(t, tunnel.totalBytesSent, tunnel.totalBytesQueued)
+}
+
+func TestWriteFlushesAfterCoalesceDelay(t *testing.T) {
+	tunnel := connectedTunnel(t)
+	assert.NoError(t, tunnel.SetCoalesceDelay(10*time.Millisecond))
+
+	_, err := tunnel.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = tunnel.Write([]byte(" world"))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(tunnel.outbound) == 1
+	}, time.Second, time.Millisecond)
+	f := <-tunnel.outbound
+	assert.Equal(t, []byte("hello world"), f.payload)
+}
+
+func TestResumeSendsCoalescedData(t *testing.T) {
+	tunnel := connectedTunnel(t)
+	assert.NoError(t, tunnel.SetCoalesceDelay(time.Hour))
+
+	_, err := tunnel.Write([]byte("hello"))
+	assert.NoError(t, err)
+	tunnel.setConnected(false)
+
+	assert.NoError(t, tunnel.resume(0))
+	assert.Equal(t, []int{5}, queuedPayloads(tunnel))
+}
+
+func TestSetCoalesceDelayRejectsNegativeDelay(t *testing.T) {
+	tunnel := NewIAPTunnel(IAPHost{}, nil, nil)
+	assert.Error(t, tunnel.SetCoalesceDelay(-time.Millisecond))
+}
+
+func TestReadDeadline(t *testing.T) {
+	tunnel := connectedTunnel(t)
+
+	done := make(chan error)
+	go func() {
+		_, err := tunnel.Read(make([]byte, 16))
+		done <- err
+	}()
+
+	assert.NoError(t, tunnel.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		var netErr net.Error
+		assert.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout())
+	case <-time.After(time.Second):
+		t.Fatal("Read should be interrupted by the deadline")
+	}
+
+	tunnel.handleData(&RelayDataFrame{Data: []byte("hello")})
+	_, err := tunnel.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded, "an expired deadline fails Read even if data is buffered")
+
+	assert.NoError(t, tunnel.SetReadDeadline(time.Time{}))
+	n, err := tunnel.Read(make([]byte, 16))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+}
+
+func TestWriteDeadlineOnFullSendWindow(t *testing.T) {
+	tunnel := connectedTunnel(t)
+	assert.NoError(t, tunnel.SetSendWindow(MinSendWindow))
+	go func() {
+		for range tunnel.outbound { // discard frames
+		}
+	}()
+
+	assert.NoError(t, tunnel.SetWriteDeadline(time.Now().Add(20*time.Millisecond)))
+	n, err := tunnel.Write(make([]byte, 2*MinSendWindow))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, MinSendWindow, n, "bytes within the send window are written")
+
+	_, err = tunnel.Write([]byte("x"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	tunnel.handleACK(&RelayACKFrame{ACK: MinSendWindow})
+	assert.NoError(t, tunnel.SetWriteDeadline(time.Time{}))
+	n, err = tunnel.Write([]byte("x"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestWriteDeadlineOnFullQueue(t *testing.T) {
+	tunnel := connectedTunnel(t)
+	for i := 0; i < outboundQueueLen; i++ {
+		_, err := tunnel.Write([]byte("x"))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, tunnel.SetWriteDeadline(time.Now().Add(20*time.Millisecond)))
+	n, err := tunnel.Write([]byte("blocked"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Zero(t, n)
+
+	tunnel.sendMu.Lock()
+	defer tunnel.sendMu.Unlock()
+	assert.Equal(t, uint64(outboundQueueLen), tunnel.totalBytesSent, "bytes which were not queued are given back")
+	assert.Equal(t, outboundQueueLen, tunnel.sendBuffer.Len())
+}
+
+func TestCloseWithStuckWriter(t *testing.T) {
+	timeout := flushTimeout
+	flushTimeout = 50 * time.Millisecond
+	defer func() { flushTimeout = timeout }()
+
+	tunnel := connectedTunnel(t)
+	assert.NoError(t, tunnel.SetCoalesceDelay(time.Hour))
+	for len(tunnel.outbound) < cap(tunnel.outbound) {
+		tunnel.outbound <- outboundFrame{} // the writer loop never drains the queue
+	}
+	_, err := tunnel.Write([]byte("held back"))
+	assert.NoError(t, err)
+
+	closed := make(chan struct{})
+	go func() {
+		tunnel.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on the full queue")
+	}
+}
+
+func TestTunnelAddresses(t *testing.T) {
+	host := IAPHost{ProjectID: "test-project", Zone: "us-central1-a", Instance: "vm", Port: "22"}
+	tunnel := NewIAPTunnel(host, nil, nil)
+
+	assert.Equal(t, "iap", tunnel.RemoteAddr().Network())
+	assert.Equal(t, "test-project/us-central1-a/vm:22", tunnel.RemoteAddr().String())
+	assert.NotNil(t, tunnel.LocalAddr(), "LocalAddr is never nil")
+}
+
+func TestCloseWrite(t *testing.T) {
+	tunnel := connectedTunnel(t)
+	assert.NoError(t, tunnel.SetCoalesceDelay(time.Hour))
+
+	_, err := tunnel.Write([]byte("request"))
+	assert.NoError(t, err)
+	assert.NoError(t, tunnel.CloseWrite())
+	assert.Equal(t, []int{len("request")}, queuedPayloads(tunnel), "held back bytes are sent")
+	assert.NoError(t, tunnel.CloseWrite(), "CloseWrite is idempotent")
+
+	_, err = tunnel.Write([]byte("more"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	tunnel.handleData(&RelayDataFrame{Data: []byte("reply")})
+	buf := make([]byte, 16)
+	n, err := tunnel.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "reply", string(buf[:n]), "the receiving side stays open")
+}
+
+func TestSetKeepAliveRejectsInvalidValues(t *testing.T) {
+	tunnel := NewIAPTunnel(IAPHost{}, nil, nil)
+	assert.Error(t, tunnel.SetPingInterval(-time.Second, time.Second))
+	assert.Error(t, tunnel.SetPingInterval(time.Second, 0))
+	assert.NoError(t, tunnel.SetPingInterval(0, 0), "pings can be disabled")
+	assert.Error(t, tunnel.SetIdleTimeout(-time.Second))
+}
+
+func TestIsHungMessage(t *testing.T) {
+	decode := func(msg []byte) []Frame {
+		frames, err := new(FrameDecoder).Decode(msg)
+		assert.NoError(t, err)
+		return frames
+	}
+
+	assert.True(t, isHungMessage(decode(make([]byte, HangedMessageLen))))
+	assert.False(t, isHungMessage(decode(make([]byte, HangedMessageLen-1))), "unknown frames of other lengths are discarded")
+
+	data := binary.BigEndian.AppendUint16(nil, RelayData)
+	data = binary.BigEndian.AppendUint32(data, HangedMessageLen-DataMessageHeaderLen)
+	data = append(data, make([]byte, HangedMessageLen-DataMessageHeaderLen)...)
+	assert.False(t, isHungMessage(decode(data)), "a data frame of the same length is valid")
+}
@@ -0,0 +1,108 @@
+package iap
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// outboundFrame is a frame queued for the writer loop, it is encoded while it is written.
+// It is bound to the websocket which was current when it was queued, frames for a replaced websocket fail
+// and their data is replayed after the session is resumed.
+type outboundFrame struct {
+	ws      *websocket.Conn
+	tag     uint16
+	payload []byte // data frames only, references the replay buffer
+	ack     uint64 // ACK frames only
+}
+
+// startWriter starts the writer loop, it is the only goroutine writing to the websocket.
+func (t *IAPTunnel) startWriter() {
+	t.writerOnce.Do(func() {
+		go t.writeLoop()
+	})
+}
+
+// stopWriter waits until the writer loop has flushed the queued frames and exited, or flushTimeout has passed.
+// It must only be called after the tunnel is closed. A writer stuck on a dead connection exits once the
+// websocket is closed.
+func (t *IAPTunnel) stopWriter() {
+	t.writerOnce.Do(func() {
+		close(t.writerDone) // the writer was never started
+	})
+
+	timer := time.NewTimer(flushTimeout)
+	defer timer.Stop()
+	select {
+	case <-t.writerDone:
+	case <-timer.C:
+		t.logger.Warn("Timed out flushing queued frames")
+	}
+}
+
+// writeLoop writes queued frames in order until the tunnel is closed, then flushes what is left in the queue.
+func (t *IAPTunnel) writeLoop() {
+	defer close(t.writerDone)
+	var hdr [ACKHeaderLen]byte // header scratch space, large enough for data and ACK frames
+	for {
+		select {
+		case f := <-t.outbound:
+			t.writeFrame(f, hdr[:])
+		case <-t.closed:
+			for {
+				select {
+				case f := <-t.outbound:
+					t.writeFrame(f, hdr[:])
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeFrame writes a single frame. Failures are only logged, the read loop notices the broken websocket
+// and resumes the session, which replays all unacknowledged data. A write blocked on a dead connection
+// is released when the websocket is closed on reconnect or close.
+func (t *IAPTunnel) writeFrame(f outboundFrame, hdr []byte) {
+	if f.ws == nil {
+		return
+	}
+
+	var err error
+	if f.tag == RelayACK {
+		err = writeACKFrame(context.Background(), f.ws, hdr, f.ack)
+	} else {
+		err = writeDataFrame(context.Background(), f.ws, hdr, f.payload)
+	}
+
+	if err != nil {
+		t.logger.Debug("Failed to send frame, waiting for reconnect", "err", err)
+	}
+}
+
+// enqueueData queues a data frame for the current websocket, blocking while the queue is full or until cancel
+// is closed. The payload must stay unmodified until the relay acknowledges it.
+func (t *IAPTunnel) enqueueData(payload []byte, cancel <-chan struct{}) error {
+	return t.enqueue(outboundFrame{tag: RelayData, payload: payload}, cancel)
+}
+
+// enqueueACK queues an ACK frame for the current websocket, blocking while the queue is full.
+func (t *IAPTunnel) enqueueACK(ack uint64) error {
+	return t.enqueue(outboundFrame{tag: RelayACK, ack: ack}, nil)
+}
+
+// enqueue queues a frame, a closed cancel channel means the write deadline has passed.
+func (t *IAPTunnel) enqueue(f outboundFrame, cancel <-chan struct{}) error {
+	f.ws = t.getWS()
+	select {
+	case t.outbound <- f:
+		return nil
+	case <-t.closed:
+		return t.closeErr()
+	case <-cancel:
+		return os.ErrDeadlineExceeded
+	}
+}
@@ -21,8 +21,17 @@ type ZapLogger struct {
 }
 
 func NewZapLogger(level string) (Logger, error) {
+	return NewZapLoggerWithOutput(level, "")
+}
+
+// NewZapLoggerWithOutput creates a logger which appends to the file at path, or writes to stderr if path is empty.
+// Logs never go to stdout, which carries the tunnel data in stdio mode.
+func NewZapLoggerWithOutput(level, path string) (Logger, error) {
 	lcLevel := strings.ToLower(level)
 	cfg := zap.NewProductionConfig()
+	if path != "" {
+		cfg.OutputPaths = []string{path}
+	}
 	cfg.EncoderConfig.CallerKey = ""
 	cfg.EncoderConfig.EncodeTime = zapcore.RFC3339TimeEncoder
 	switch lcLevel {
@@ -37,7 +46,10 @@ func NewZapLogger(level string) (Logger, error) {
 	default:
 		return nil, fmt.Errorf("unsupported log level: %s", level)
 	}
-	z, _ := cfg.Build()
+	z, err := cfg.Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create logger: %w", err)
+	}
 	return &ZapLogger{logger: z.Sugar()}, nil
 }
 